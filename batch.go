@@ -0,0 +1,81 @@
+package drbuffer
+
+import "errors"
+
+var ErrStaleBatch = errors.New("batch is stale")
+
+// Batch holds the packets returned by Pop, they will be delivered again after reopen unless committed.
+// Packets point into the buffer, they are valid until committed
+type Batch struct {
+	Packets [][]byte
+	// Sequences are the sequence numbers of Packets, a gap means the packets between were dropped or corrupted.
+	// they are all 0 before version 5
+	Sequences []uint64
+	owner     batchOwner
+	readFrom  uint64
+	readTo    uint64
+	pop       uint64
+	rewinds   uint64
+}
+
+type batchOwner interface {
+	commitBatch(batch *Batch) error
+	nackBatch(batch *Batch) error
+}
+
+// Commit moves lastReadTo after this batch, the batches popped before it are committed as well
+func (batch *Batch) Commit() error {
+	return batch.owner.commitBatch(batch)
+}
+
+// Nack rewinds the reader to the start of this batch, the batch and everything popped after it will be popped again.
+// all the uncommitted batches become stale
+func (batch *Batch) Nack() error {
+	return batch.owner.nackBatch(batch)
+}
+
+// Pop does not commit anything, commit the batch or call Commit when the packets are processed
+func (cursor *cursor) Pop(maxPacketsCount int) (*Batch, error) {
+	readFrom := cursor.nextReadFrom
+	packets, err := cursor.readN(maxPacketsCount)
+	cursor.poppedPackets.add(uint64(len(packets)))
+	cursor.popsCount += 1
+	return &Batch{
+		Packets:   append([][]byte(nil), packets...),
+		Sequences: append([]uint64(nil), cursor.reusableSequenceList[:len(packets)]...),
+		owner:     cursor,
+		readFrom:  readFrom,
+		readTo:    cursor.nextReadFrom,
+		pop:       cursor.popsCount,
+		rewinds:   cursor.rewinds,
+	}, err
+}
+
+// Commit marks every popped packet consumed
+func (cursor *cursor) Commit() {
+	cursor.lastReadTo.store(cursor.nextReadFrom)
+	cursor.committedPops = cursor.popsCount
+}
+
+func (cursor *cursor) commitBatch(batch *Batch) error {
+	if batch.rewinds != cursor.rewinds {
+		return ErrStaleBatch
+	}
+	if batch.pop <= cursor.committedPops {
+		// committed by a later batch already
+		return nil
+	}
+	cursor.lastReadTo.store(batch.readTo)
+	cursor.committedPops = batch.pop
+	return nil
+}
+
+func (cursor *cursor) nackBatch(batch *Batch) error {
+	if batch.rewinds != cursor.rewinds || batch.pop <= cursor.committedPops {
+		return ErrStaleBatch
+	}
+	cursor.nextReadFrom = batch.readFrom
+	cursor.rewinds += 1
+	cursor.pendingCounted = false
+	return nil
+}
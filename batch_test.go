@@ -0,0 +1,89 @@
+package drbuffer
+
+import (
+	"testing"
+)
+
+func Test_pop_does_not_commit(t *testing.T) {
+	assert := NewAssert(t)
+	buffer := newBuffer(10)
+	buffer.PushN([][]byte{
+		[]byte("A"),
+		[]byte("B"),
+	})
+	batch, err := buffer.Pop(1024)
+	assert(err, "==", nil)
+	assert(len(batch.Packets), "==", 2)
+	batch, err = buffer.Pop(1024)
+	assert(len(batch.Packets), "==", 0)
+	assert(buffer.lastReadTo.load(), "==", uint64(0)) // nothing committed
+	assert(buffer.nextReadFrom, "==", uint64(6))
+}
+
+func Test_commit_batch(t *testing.T) {
+	assert := NewAssert(t)
+	buffer := newBuffer(10)
+	buffer.PushN([][]byte{
+		[]byte("A"),
+		[]byte("B"),
+	})
+	first, _ := buffer.Pop(1)
+	second, _ := buffer.Pop(1)
+	assert(string(first.Packets[0]), "==", "A")
+	assert(string(second.Packets[0]), "==", "B")
+	assert(first.Commit(), "==", nil)
+	assert(buffer.lastReadTo.load(), "==", uint64(3))
+	assert(second.Commit(), "==", nil)
+	assert(buffer.lastReadTo.load(), "==", uint64(6))
+	assert(first.Commit(), "==", nil) // committed already, do not move back
+	assert(buffer.lastReadTo.load(), "==", uint64(6))
+}
+
+func Test_nack_batch(t *testing.T) {
+	assert := NewAssert(t)
+	buffer := newBuffer(10)
+	buffer.PushN([][]byte{
+		[]byte("A"),
+		[]byte("B"),
+		[]byte("C"),
+	})
+	first, _ := buffer.Pop(1)
+	second, _ := buffer.Pop(1)
+	third, _ := buffer.Pop(1)
+	assert(second.Nack(), "==", nil)
+	assert(buffer.nextReadFrom, "==", uint64(3))
+	assert(buffer.lastReadTo.load(), "==", uint64(0))
+	assert(third.Commit(), "==", ErrStaleBatch)
+	assert(first.Nack(), "==", ErrStaleBatch)
+	batch, _ := buffer.Pop(1024)
+	assert(len(batch.Packets), "==", 2)
+	assert(string(batch.Packets[0]), "==", "B")
+	assert(string(batch.Packets[1]), "==", "C")
+	assert(batch.Commit(), "==", nil)
+	assert(buffer.lastReadTo.load(), "==", uint64(9))
+	assert(batch.Nack(), "==", ErrStaleBatch) // committed already
+}
+
+func Test_commit_without_pop(t *testing.T) {
+	assert := NewAssert(t)
+	buffer := newBuffer(10)
+	buffer.PushOne([]byte("A"))
+	batch, _ := buffer.Pop(1024)
+	buffer.Commit()
+	assert(buffer.lastReadTo.load(), "==", uint64(3))
+	assert(batch.Commit(), "==", nil)
+}
+
+func Test_overwritten_batch_is_stale(t *testing.T) {
+	assert := NewAssert(t)
+	buffer := newBuffer(10)
+	buffer.PushN([][]byte{
+		[]byte("A"),
+		[]byte("B"),
+		[]byte("C"),
+	})
+	batch, _ := buffer.Pop(1)
+	buffer.PushOne([]byte("DD"))
+	assert(batch.Commit(), "==", ErrStaleBatch)
+	assert(buffer.lastReadTo.load(), "==", uint64(6))
+}
@@ -1,159 +1,585 @@
 package drbuffer
 
 import (
+	"encoding/binary"
+	"errors"
 	"fmt"
+	"hash/crc32"
 	"math"
 	"unsafe"
 )
 
-const META_SECTION_SIZE = 16 // 4 for version 4 for nextWriteFrom 4 for lastReadTo 4 for wrapAt
 const MAX_PACKETS_READ_ONE_TIME = 1024
 const IS_DEBUG = false
+const CURRENT_VERSION = 5
+
+var ErrPacketTooLarge = errors.New("packet too large")
+var ErrFull = errors.New("buffer is full")
+
+// OverflowPolicy decides what happens when a push would overwrite packets not read yet.
+// before the policies the reader was moved to 0 instead, dropping the rest of the previous lap with the overwritten packets
+type OverflowPolicy int
+
+const (
+	OverwriteOldest OverflowPolicy = iota // move the reader past the overwritten packets and count them as dropped
+	RejectNewest                          // fail the push with ErrFull
+	BlockUntilSpace                       // wait for the reader to free up space
+)
+
+var castagnoliTable = crc32.MakeTable(crc32.Castagnoli)
+
+// recordFormat describes how a packet is framed inside the data section
+type recordFormat struct {
+	lengthSize  uint64 // bytes used by the length prefix
+	checksummed bool   // crc32c of the rest of the record follows the length prefix
+	sequenced   bool   // the sequence number of the packet follows the checksum
+}
+
+// version 1: [2 length][payload]
+// version 2: [2 length][4 crc32c][payload]
+// version 3 and 4: [4 length][4 crc32c][payload]
+// version 5: [4 length][4 crc32c][8 sequence][payload]
+var recordFormats = map[uint32]recordFormat{
+	1: {lengthSize: 2},
+	2: {lengthSize: 2, checksummed: true},
+	3: {lengthSize: 4, checksummed: true},
+	4: {lengthSize: 4, checksummed: true},
+	5: {lengthSize: 4, checksummed: true, sequenced: true},
+}
+
+type CorruptionError struct {
+	Offset  uint64 // where the invalid record starts in the data section
+	Skipped uint64 // bytes skipped to reach the next valid record
+	Reason  string
+}
+
+func (err *CorruptionError) Error() string {
+	return fmt.Sprintf("corrupted record at %d: %s, skipped %d bytes", err.Offset, err.Reason, err.Skipped)
+}
 
 type ringBuffer struct {
-	data               []byte // store packets
-	version            *uint32
-	nextWriteFrom      *uint32
-	lastReadTo         *uint32
-	wrapAt             *uint32
-	nextReadFrom       uint32
+	cursor         // the default consumer
+	meta           []byte
+	data           []byte // store packets
+	format         recordFormat
+	version        *uint32
+	nextWriteFrom  metaField
+	wrapAt         metaField
+	lastSequence   metaField // the sequence number of the last pushed packet, only version 5 stores it
+	totalPushed    metaField
+	wraps          metaField
+	cursors        []*cursor // the default consumer and named consumers, every one of them is protected from overwrite
+	iterators      []*cursor // moved past the overwritten packets like consumers, but not protected
+	overflowPolicy OverflowPolicy
+	evict          evictFunc    // called with the packets the default consumer is about to lose to OverwriteOldest
+	dirty          []recordSpan // written since last flush
+	// the reader lives in another process, only it may move the read pointers
+	sharedAcrossProcesses bool
+}
+
+// cursor is the read position of one consumer
+type cursor struct {
+	ring               *ringBuffer
+	name               string
+	lastReadTo         metaField
+	nextReadFrom       uint64
+	popsCount          uint64 // identifies the batches
+	committedPops      uint64 // batches up to this one are committed
+	rewinds            uint64 // read pointers moved back, the batches popped before become stale
+	removed            bool
+	droppedPackets     metaField
+	poppedPackets      metaField // redelivered packets are counted again
+	pendingCount       int       // packets from nextReadFrom to nextWriteFrom, kept up to date once counted
+	pendingCounted     bool
 	reusablePacketList [][]byte
+	// sequence numbers of the packets in reusablePacketList
+	reusableSequenceList []uint64
 }
 
+// NewRingBuffer takes zeroed meta of META_SECTION_SIZE as a new buffer of version 1, the format it had before versions
 func NewRingBuffer(meta []byte, buffer []byte) *ringBuffer {
-	if len(meta) != META_SECTION_SIZE {
-		panic(fmt.Sprintf("meta should of size: %s", META_SECTION_SIZE))
+	if len(meta) == META_SECTION_SIZE && readVersion(meta) == 0 {
+		*(*uint32)(unsafe.Pointer(&meta[0])) = 1
+	}
+	version := readVersion(meta)
+	format, found := recordFormats[version]
+	if !found {
+		panic(fmt.Sprintf("unsupported version: %d", version))
 	}
-	lastReadTo := (*uint32)(unsafe.Pointer(&meta[8]))
-	return &ringBuffer{
-		data:               buffer,
-		version:            (*uint32)(unsafe.Pointer(&meta[0])),
-		nextWriteFrom:      (*uint32)(unsafe.Pointer(&meta[4])),
-		lastReadTo:         lastReadTo,
-		wrapAt:             (*uint32)(unsafe.Pointer(&meta[12])),
-		nextReadFrom:       *lastReadTo,
-		reusablePacketList: make([][]byte, MAX_PACKETS_READ_ONE_TIME),
+	if len(meta) != metaSectionSize(version) {
+		panic(fmt.Sprintf("meta should of size: %d", metaSectionSize(version)))
 	}
+	ring := &ringBuffer{
+		meta:          meta,
+		data:          buffer,
+		format:        format,
+		version:       (*uint32)(unsafe.Pointer(&meta[0])),
+		nextWriteFrom: newMetaField(meta, version, 4, 8),
+		wrapAt:        newMetaField(meta, version, 12, 24),
+	}
+	if format.sequenced {
+		ring.lastSequence = newMetaField(meta, version, 0, 32)
+	}
+	ring.totalPushed = newCounterField(meta, version, 40)
+	ring.wraps = newCounterField(meta, version, 64)
+	ring.cursor = *ring.newCursor("", newMetaField(meta, version, 8, 16), newCounterField(meta, version, 56), newCounterField(meta, version, 48))
+	ring.cursors = append([]*cursor{&ring.cursor}, ring.loadConsumers()...)
+	return ring
 }
 
-type packet []byte
+func (buffer *ringBuffer) newCursor(name string, lastReadTo metaField, droppedPackets metaField, poppedPackets metaField) *cursor {
+	return &cursor{
+		ring:                 buffer,
+		name:                 name,
+		lastReadTo:           lastReadTo,
+		droppedPackets:       droppedPackets,
+		poppedPackets:        poppedPackets,
+		nextReadFrom:         lastReadTo.load(),
+		reusablePacketList:   make([][]byte, MAX_PACKETS_READ_ONE_TIME),
+		reusableSequenceList: make([]uint64, MAX_PACKETS_READ_ONE_TIME),
+	}
+}
 
-func (p packet) size() uint16 {
-	packetSizePtr := (*uint16)(unsafe.Pointer(&p[0]))
-	packetSize := *packetSizePtr
-	return packetSize
+func (format recordFormat) headerSize() uint64 {
+	headerSize := format.lengthSize
+	if format.checksummed {
+		headerSize += 4
+	}
+	if format.sequenced {
+		headerSize += 8
+	}
+	return headerSize
 }
 
-func (p packet) write(bytes []byte) {
-	if len(bytes) > math.MaxUint16 {
-		panic(fmt.Sprintf("packet too large: %s", len(bytes)))
+func (format recordFormat) maxPacketSize() uint64 {
+	if format.lengthSize == 2 {
+		return math.MaxUint16
 	}
-	packetSize := uint16(len(bytes))
-	packetSizePtr := (*uint16)(unsafe.Pointer(&p[0]))
-	*packetSizePtr = packetSize
-	copy(p[2:], bytes)
+	return math.MaxUint32
 }
 
-func (p packet) read() packet {
-	return p[2 : 2+p.size()]
+// write expects the packet size already checked against maxPacketSize, sequence is ignored if not sequenced
+func (format recordFormat) write(record []byte, bytes []byte, sequence uint64) {
+	if format.lengthSize == 2 {
+		binary.LittleEndian.PutUint16(record, uint16(len(bytes)))
+	} else {
+		binary.LittleEndian.PutUint32(record, uint32(len(bytes)))
+	}
+	if format.sequenced {
+		binary.LittleEndian.PutUint64(record[format.lengthSize+4:], sequence)
+	}
+	copy(record[format.headerSize():], bytes)
+	if format.checksummed {
+		binary.LittleEndian.PutUint32(record[format.lengthSize:], format.checksum(record, bytes))
+	}
+}
+
+// read decodes the record at the start of region, region must end where the valid data ends
+// returns the packet and the total size of the record including its header
+func (format recordFormat) read(region []byte) (packet []byte, recordSize uint64, reason string) {
+	headerSize := format.headerSize()
+	if uint64(len(region)) < headerSize {
+		return nil, 0, "truncated header"
+	}
+	packetSize := format.packetSize(region)
+	recordSize = headerSize + packetSize
+	if uint64(len(region))-headerSize < packetSize {
+		return nil, 0, fmt.Sprintf("packet size %d exceeds region", packetSize)
+	}
+	packet = region[headerSize:recordSize]
+	if format.checksummed && binary.LittleEndian.Uint32(region[format.lengthSize:]) != format.checksum(region, packet) {
+		return nil, 0, "checksum mismatch"
+	}
+	return packet, recordSize, ""
+}
+
+func (format recordFormat) packetSize(record []byte) uint64 {
+	if format.lengthSize == 2 {
+		return uint64(binary.LittleEndian.Uint16(record))
+	}
+	return uint64(binary.LittleEndian.Uint32(record))
+}
+
+// sequence expects a valid record, it is 0 if not sequenced
+func (format recordFormat) sequence(record []byte) uint64 {
+	if !format.sequenced {
+		return 0
+	}
+	return binary.LittleEndian.Uint64(record[format.lengthSize+4:])
+}
+
+func (format recordFormat) checksum(record []byte, packet []byte) uint32 {
+	crc := crc32.Update(0, castagnoliTable, record[:format.lengthSize])
+	crc = crc32.Update(crc, castagnoliTable, record[format.lengthSize+4:format.headerSize()])
+	return crc32.Update(crc, castagnoliTable, packet)
 }
 
 func (buffer *ringBuffer) PushN(pList [][]byte) {
-	writeFrom := *buffer.nextWriteFrom
-	for _, p := range pList {
-		buffer.PushOne(p)
+	if _, err := buffer.PushBatch(pList); err != nil {
+		panic(err.Error())
 	}
-	writeTo := *buffer.nextWriteFrom
+}
+
+// PushBatch stops at the first packet can not be pushed, returns how many packets pushed before it
+func (buffer *ringBuffer) PushBatch(pList [][]byte) (int, error) {
+	writeFrom := buffer.nextWriteFrom.load()
+	for i, p := range pList {
+		if err := buffer.Push(p); err != nil {
+			return i, err
+		}
+	}
+	writeTo := buffer.nextWriteFrom.load()
 	if IS_DEBUG {
 		fmt.Println("write", len(pList), "[", writeFrom, ",", writeTo, ")")
 	}
+	return len(pList), nil
 }
 
 func (buffer *ringBuffer) PushOne(p []byte) {
-	if len(p) > len(buffer.data)-2 {
-		panic(fmt.Sprintf("packet to push is too large: %s", len(p)))
-	}
-	writeFrom := *buffer.nextWriteFrom
-	writeTo := writeFrom + 2 + uint32(len(p))
-	if *buffer.wrapAt != 0 {
-		// first lap is immune
-		// read pointer in range [writeFrom, writeTo) will be repelled to safe harbour (0)
-		buffer.repelReadPointers(writeFrom, writeTo)
-	}
-	if writeTo > uint32(len(buffer.data)) {
-		*buffer.wrapAt = writeFrom
+	if err := buffer.Push(p); err != nil {
+		panic(err.Error())
+	}
+}
+
+// Push returns ErrFull instead of overwriting when overflow policy is not OverwriteOldest
+func (buffer *ringBuffer) Push(p []byte) error {
+	_, err := buffer.PushWithSequence(p)
+	return err
+}
+
+// PushWithSequence is Push returning the sequence number of the packet, it is always 0 before version 5
+func (buffer *ringBuffer) PushWithSequence(p []byte) (uint64, error) {
+	headerSize := buffer.format.headerSize()
+	if uint64(len(p))+headerSize > uint64(len(buffer.data)) || uint64(len(p)) > buffer.format.maxPacketSize() {
+		return 0, fmt.Errorf("%w: %d bytes", ErrPacketTooLarge, len(p))
+	}
+	recordSize := headerSize + uint64(len(p))
+	sequence := uint64(0)
+	if buffer.format.sequenced {
+		sequence = buffer.lastSequence.load() + 1
+	}
+	if !buffer.overwritesUnread(recordSize) {
+		buffer.write(p, recordSize, sequence, buffer.planRepel(recordSize))
+		return sequence, nil
+	}
+	if buffer.overflowPolicy != OverwriteOldest {
+		return 0, ErrFull
+	}
+	moves := buffer.planRepel(recordSize)
+	if buffer.evict != nil && len(moves[0].dropped) > 0 {
+		// the dropped packets are always the oldest ones, they are handed over while still intact
+		if err := buffer.evictRecords(moves[0].dropped); err != nil {
+			return 0, fmt.Errorf("%w: %s", ErrEvictionFailed, err.Error())
+		}
+	}
+	buffer.write(p, recordSize, sequence, moves)
+	return sequence, nil
+}
+
+// write moves the read pointers as planned by planRepel before the record
+func (buffer *ringBuffer) write(p []byte, recordSize uint64, sequence uint64, moves []cursorMove) {
+	writeFrom := buffer.nextWriteFrom.load()
+	writeTo := writeFrom + recordSize
+	if writeTo > uint64(len(buffer.data)) {
+		buffer.wrapAt.store(writeFrom)
+		buffer.wraps.add(1)
 		if IS_DEBUG {
 			fmt.Println("wrap at:", writeFrom)
 		}
 		writeFrom = 0
-		writeTo = 2 + uint32(len(p))
-		// [writeFrom, writeTo) changed, repel again
-		buffer.repelReadPointers(writeFrom, writeTo)
+		writeTo = recordSize
 	}
+	buffer.repelReadPointers(moves, writeFrom)
 	// write data first before moving nw pointer to ensure the pointing region is valid
-	packet(buffer.data[writeFrom:]).write(p)
-	*buffer.nextWriteFrom = writeTo
+	buffer.format.write(buffer.data[writeFrom:writeTo], p, sequence)
+	buffer.markDirty(writeFrom, writeTo)
+	if buffer.format.sequenced {
+		// the high-water mark moves before the record is visible, a sequence number is never handed out twice
+		buffer.lastSequence.store(sequence)
+	}
+	buffer.nextWriteFrom.store(writeTo)
+	buffer.totalPushed.add(1)
+	for _, cursor := range buffer.cursors {
+		cursor.pendingCount += 1
+	}
+}
+
+// cursorMove is where a read pointer goes to get out of the way of a write
+type cursorMove struct {
+	lastReadTo   uint64
+	nextReadFrom uint64
+	moved        bool
+	dropped      []recordSpan // overwritten before being popped
+	uncounted    bool         // skipped the rest of the lap without counting the packets
+}
+
+// planRepel tells where pushing a record will move the read pointers, nothing is changed yet
+func (buffer *ringBuffer) planRepel(recordSize uint64) []cursorMove {
+	writeFrom := buffer.nextWriteFrom.load()
+	writeTo := writeFrom + recordSize
+	wrapAt := buffer.wrapAt.load()
+	readers := buffer.readers()
+	moves := make([]cursorMove, len(readers))
+	for i, cursor := range readers {
+		moves[i] = cursorMove{lastReadTo: cursor.lastReadTo.load(), nextReadFrom: cursor.nextReadFrom}
+		if buffer.sharedAcrossProcesses {
+			continue
+		}
+		if wrapAt != 0 {
+			// first lap is immune
+			cursor.skipOverwritten(&moves[i], writeFrom, writeTo, wrapAt)
+		}
+		if writeTo > uint64(len(buffer.data)) {
+			// wraps, the start of the lap ending at writeFrom is overwritten
+			cursor.skipOverwritten(&moves[i], 0, recordSize, writeFrom)
+		}
+	}
+	return moves
+}
+
+// skipOverwritten moves a read pointer in range [writeFrom, writeTo] to the first record after it,
+// or to 0 once the lap ending at lapEnd is left behind.
+// do not allow lastReadTo == writeTo which implies not allow nextReadFrom == writeTo
+// this way, when nextReadFrom == nextWriteTo, the queue is empty
+func (cursor *cursor) skipOverwritten(move *cursorMove, writeFrom, writeTo, lapEnd uint64) {
+	ring := cursor.ring
+	if move.lastReadTo == writeFrom && move.lastReadTo == ring.nextWriteFrom.load() {
+		// the queue is empty, reader just follows the writer
+		return
+	}
+	if move.lastReadTo < writeFrom || writeTo < move.lastReadTo {
+		return
+	}
+	// the packets from lastReadTo to nextReadFrom are popped already, they are lost but not dropped
+	popped := move.nextReadFrom != move.lastReadTo
+	pos := move.lastReadTo
+	for pos <= writeTo {
+		if pos == move.nextReadFrom {
+			popped = false
+		}
+		if pos >= lapEnd {
+			pos = 0
+			break
+		}
+		_, recordSize, reason := ring.format.read(ring.data[pos:lapEnd])
+		if reason != "" {
+			// the rest of the lap can not be trusted
+			pos = 0
+			move.uncounted = true
+			break
+		}
+		if !popped {
+			move.dropped = append(move.dropped, recordSpan{pos, pos + recordSize})
+		}
+		pos += recordSize
+	}
+	move.lastReadTo = pos
+	if !popped {
+		// nextReadFrom was in the overwritten records too
+		move.nextReadFrom = pos
+	}
+	move.moved = true
 }
 
-func (buffer *ringBuffer) repelReadPointers(writeFrom, writeTo uint32) {
-	if writeFrom <= *buffer.lastReadTo && *buffer.lastReadTo <= writeTo {
-		// move lastReadTo to avoid overwrite, 0 always point to a valid packet
-		// do not allow lastReadTo == writeTo which implies not allow nextReadFrom == writeTo
-		// this way, when nextReadFrom == nextWriteTo, the queue is empty
-		*buffer.lastReadTo = 0
-		*buffer.wrapAt = 0
-		buffer.nextReadFrom = 0
+func (buffer *ringBuffer) repelReadPointers(moves []cursorMove, writeFrom uint64) {
+	repelled := false
+	for i, cursor := range buffer.readers() {
+		if moves[i].moved {
+			cursor.repel(moves[i])
+			repelled = true
+		}
+	}
+	if repelled && buffer.allCursorsBefore(writeFrom) {
+		// no one left in previous lap
+		buffer.wrapAt.store(0)
+	}
+}
+
+// readers are the cursors write moves out of its way, the consumers first
+func (buffer *ringBuffer) readers() []*cursor {
+	if len(buffer.iterators) == 0 {
+		return buffer.cursors
+	}
+	return append(append([]*cursor(nil), buffer.cursors...), buffer.iterators...)
+}
+
+func (buffer *ringBuffer) allCursorsBefore(pos uint64) bool {
+	for _, cursor := range buffer.readers() {
+		if cursor.lastReadTo.load() > pos || cursor.nextReadFrom > pos {
+			return false
+		}
+	}
+	return true
+}
+
+func (cursor *cursor) repel(move cursorMove) {
+	cursor.lastReadTo.store(move.lastReadTo)
+	cursor.nextReadFrom = move.nextReadFrom
+	cursor.rewinds += 1
+	cursor.droppedPackets.add(uint64(len(move.dropped)))
+	cursor.pendingCount -= len(move.dropped)
+	if move.uncounted {
+		cursor.pendingCounted = false
+	}
+}
+
+// overwritesUnread tells if pushing a record would destroy packets not committed by any consumer
+func (buffer *ringBuffer) overwritesUnread(recordSize uint64) bool {
+	for _, cursor := range buffer.cursors {
+		if cursor.overwritesUnread(recordSize) {
+			return true
+		}
 	}
-	// do not need to check buffer.nextReadFrom as buffer.lastReadTo will always be encountered first
+	return false
 }
 
-func (buffer *ringBuffer) PopN(maxPacketsCount int) [][]byte {
+// skipOverwritten also moves a reader already at the end of previous lap to 0, which loses nothing
+func (cursor *cursor) overwritesUnread(recordSize uint64) bool {
+	readFrom := cursor.lastReadTo.load()
+	nextWriteFrom := cursor.ring.nextWriteFrom.load()
+	if readFrom == nextWriteFrom {
+		return false
+	}
+	if readFrom > nextWriteFrom && readFrom == cursor.ring.wrapAt.load() && !cursor.ring.sharedAcrossProcesses {
+		// nothing left in previous lap, the unread packets start from 0
+		// across processes the reader is not repelled, it has to move to the current lap by itself
+		readFrom = 0
+	}
+	if readFrom > nextWriteFrom {
+		// in previous lap, reaching it or wrapping around (which moves wrapAt) both overwrite
+		return readFrom <= nextWriteFrom+recordSize
+	}
+	return nextWriteFrom+recordSize > uint64(len(cursor.ring.data)) && readFrom <= recordSize
+}
+
+// pendingPackets counts the packets next PopN will see, the records are only walked when the count is not known.
+// across processes the other process moves the pointers, so they are walked every time
+func (cursor *cursor) pendingPackets() int {
+	if !cursor.pendingCounted || cursor.ring.sharedAcrossProcesses {
+		cursor.pendingCount = cursor.countPending()
+		cursor.pendingCounted = true
+	}
+	return cursor.pendingCount
+}
+
+func (cursor *cursor) countPending() int {
+	ring := cursor.ring
+	nextWriteFrom := ring.nextWriteFrom.load()
+	if cursor.nextReadFrom > nextWriteFrom {
+		return ring.countRecords(cursor.nextReadFrom, ring.wrapAt.load()) + ring.countRecords(0, nextWriteFrom)
+	}
+	return ring.countRecords(cursor.nextReadFrom, nextWriteFrom)
+}
+
+func (buffer *ringBuffer) countRecords(readFrom, readTo uint64) int {
+	count := 0
+	for pos := readFrom; pos < readTo; count++ {
+		_, recordSize, reason := buffer.format.read(buffer.data[pos:readTo])
+		if reason != "" {
+			break
+		}
+		pos += recordSize
+	}
+	return count
+}
+
+// DroppedPackets counts packets overwritten before being read, only OverwriteOldest drops packets
+func (cursor *cursor) DroppedPackets() uint64 {
+	return cursor.droppedPackets.load()
+}
+
+// PopN returns the packets only, the sequence numbers are in the Sequences of the batch Pop returns
+func (cursor *cursor) PopN(maxPacketsCount int) [][]byte {
+	packets, _ := cursor.PopNChecked(maxPacketsCount)
+	return packets
+}
+
+// PopNChecked is PopN reporting corrupted records as *CorruptionError
+// the returned packets are always valid, the corrupted region has been skipped when error returned
+func (cursor *cursor) PopNChecked(maxPacketsCount int) ([][]byte, error) {
+	cursor.Commit()
+	packets, err := cursor.readN(maxPacketsCount)
+	cursor.poppedPackets.add(uint64(len(packets)))
+	return packets, err
+}
+
+// readN moves nextReadFrom only, the packets are not committed
+func (cursor *cursor) readN(maxPacketsCount int) ([][]byte, error) {
+	packets, err := cursor.readPackets(maxPacketsCount)
+	cursor.pendingCount -= len(packets)
+	if err != nil {
+		// the corrupted records skipped were not counted
+		cursor.pendingCounted = false
+	}
+	return packets, err
+}
+
+func (cursor *cursor) readPackets(maxPacketsCount int) ([][]byte, error) {
 	if maxPacketsCount > MAX_PACKETS_READ_ONE_TIME {
 		maxPacketsCount = MAX_PACKETS_READ_ONE_TIME
 	}
-	*buffer.lastReadTo = buffer.nextReadFrom
-	if buffer.nextReadFrom == *buffer.nextWriteFrom {
-		return buffer.reusablePacketList[:0]
+	nextWriteFrom := cursor.ring.nextWriteFrom.load()
+	if cursor.nextReadFrom == nextWriteFrom {
+		return cursor.reusablePacketList[:0], nil
 	}
-	if buffer.nextReadFrom > *buffer.nextWriteFrom {
+	if cursor.nextReadFrom > nextWriteFrom {
 		// write is in the next lap now, we finish the first lap at wrapAt
-		packetsCount, readTo := buffer.readRegion(buffer.nextReadFrom, *buffer.wrapAt, 0, maxPacketsCount)
-		if packetsCount >= maxPacketsCount {
-			buffer.nextReadFrom = readTo
-			return buffer.reusablePacketList[:packetsCount]
+		packetsCount, readTo, err := cursor.readRegion(cursor.nextReadFrom, cursor.ring.wrapAt.load(), 0, maxPacketsCount)
+		if packetsCount >= maxPacketsCount || err != nil {
+			cursor.nextReadFrom = readTo
+			return cursor.reusablePacketList[:packetsCount], err
 		} else {
 			// catch up the second lap
-			packetsCount, readTo = buffer.readRegion(0, *buffer.nextWriteFrom, packetsCount, maxPacketsCount)
-			buffer.nextReadFrom = readTo
-			return buffer.reusablePacketList[:packetsCount]
+			packetsCount, readTo, err = cursor.readRegion(0, nextWriteFrom, packetsCount, maxPacketsCount)
+			cursor.nextReadFrom = readTo
+			return cursor.reusablePacketList[:packetsCount], err
 		}
 	} else {
 		// we are at the same lap
-		packetsCount, readTo := buffer.readRegion(buffer.nextReadFrom, *buffer.nextWriteFrom, 0, maxPacketsCount)
-		buffer.nextReadFrom = readTo
-		return buffer.reusablePacketList[:packetsCount]
+		packetsCount, readTo, err := cursor.readRegion(cursor.nextReadFrom, nextWriteFrom, 0, maxPacketsCount)
+		cursor.nextReadFrom = readTo
+		return cursor.reusablePacketList[:packetsCount], err
 	}
 }
 
-func (buffer *ringBuffer) readRegion(readFrom, readTo uint32, packetsCount int, maxPacketsCount int) (int, uint32) {
+// readRegion stops at the first invalid record, and returns the position of next valid record as readTo
+func (cursor *cursor) readRegion(readFrom, readTo uint64, packetsCount int, maxPacketsCount int) (int, uint64, error) {
 	if IS_DEBUG {
 		fmt.Println("read [", readFrom, ",", readTo, ")")
 	}
 	pos := readFrom
 	for pos < readTo && packetsCount < maxPacketsCount {
+		p, recordSize, reason := cursor.ring.format.read(cursor.ring.data[pos:readTo])
+		if reason != "" {
+			nextValid := cursor.ring.findNextValidRecord(pos+1, readTo)
+			return packetsCount, nextValid, &CorruptionError{Offset: pos, Skipped: nextValid - pos, Reason: reason}
+		}
 		if IS_DEBUG {
-			fmt.Println("read packet of size: ", packet(buffer.data[pos:]).size())
+			fmt.Println("read packet of size: ", len(p))
 		}
-		p := packet(buffer.data[pos:]).read()
-		buffer.reusablePacketList[packetsCount] = p
-		pos = pos + 2 + uint32(len(p))
+		cursor.reusablePacketList[packetsCount] = p
+		cursor.reusableSequenceList[packetsCount] = cursor.ring.format.sequence(cursor.ring.data[pos:])
+		pos = pos + recordSize
 		packetsCount += 1
 	}
-	return packetsCount, pos
+	return packetsCount, pos, nil
+}
+
+// findNextValidRecord scans for a record passing checksum, without checksum the rest of the region can not be trusted
+func (buffer *ringBuffer) findNextValidRecord(searchFrom, readTo uint64) uint64 {
+	if !buffer.format.checksummed {
+		return readTo
+	}
+	for pos := searchFrom; pos+buffer.format.headerSize() <= readTo; pos++ {
+		if _, _, reason := buffer.format.read(buffer.data[pos:readTo]); reason == "" {
+			return pos
+		}
+	}
+	return readTo
 }
 
-func (buffer *ringBuffer) PopOne() []byte {
-	packets := buffer.PopN(1)
+func (cursor *cursor) PopOne() []byte {
+	packets := cursor.PopN(1)
 	if len(packets) > 0 {
 		return packets[0]
 	} else {
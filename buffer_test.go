@@ -1,6 +1,10 @@
 package drbuffer
 
 import (
+	"encoding/binary"
+	"errors"
+	"hash/crc32"
+	"math"
 	"math/rand"
 	"testing"
 )
@@ -8,15 +12,15 @@ import (
 func Test_push_to_empty(t *testing.T) {
 	assert := NewAssert(t)
 	buffer := newBuffer(10)
-	assert(*buffer.nextWriteFrom, "==", uint32(0))
-	assert(buffer.nextReadFrom, "==", uint32(0))
-	assert(*buffer.lastReadTo, "==", uint32(0))
-	assert(*buffer.wrapAt, "==", uint32(0))
+	assert(buffer.nextWriteFrom.load(), "==", uint64(0))
+	assert(buffer.nextReadFrom, "==", uint64(0))
+	assert(buffer.lastReadTo.load(), "==", uint64(0))
+	assert(buffer.wrapAt.load(), "==", uint64(0))
 	buffer.PushOne([]byte("A"))
-	assert(*buffer.nextWriteFrom, "==", uint32(3)) // 3 bytes used to store packet size and "A"
-	assert(buffer.nextReadFrom, "==", uint32(0))   // because not popped yet
-	assert(*buffer.lastReadTo, "==", uint32(0))    // because not popped yet
-	assert(*buffer.wrapAt, "==", uint32(0))        // break not moved, as not wrapped around yet
+	assert(buffer.nextWriteFrom.load(), "==", uint64(3)) // 3 bytes used to store packet size and "A"
+	assert(buffer.nextReadFrom, "==", uint64(0))         // because not popped yet
+	assert(buffer.lastReadTo.load(), "==", uint64(0))    // because not popped yet
+	assert(buffer.wrapAt.load(), "==", uint64(0))        // break not moved, as not wrapped around yet
 }
 
 func Test_pop_from_empty(t *testing.T) {
@@ -24,10 +28,10 @@ func Test_pop_from_empty(t *testing.T) {
 	buffer := newBuffer(10)
 	packet := buffer.PopOne()
 	assert(packet, "==", nil)
-	assert(*buffer.nextWriteFrom, "==", uint32(0)) // nothing moved yet
-	assert(buffer.nextReadFrom, "==", uint32(0))   // nothing moved yet
-	assert(*buffer.lastReadTo, "==", uint32(0))    // nothing moved yet
-	assert(*buffer.wrapAt, "==", uint32(0))        // nothing moved yet
+	assert(buffer.nextWriteFrom.load(), "==", uint64(0)) // nothing moved yet
+	assert(buffer.nextReadFrom, "==", uint64(0))         // nothing moved yet
+	assert(buffer.lastReadTo.load(), "==", uint64(0))    // nothing moved yet
+	assert(buffer.wrapAt.load(), "==", uint64(0))        // nothing moved yet
 }
 
 func Test_push_pop(t *testing.T) {
@@ -36,10 +40,10 @@ func Test_push_pop(t *testing.T) {
 	buffer.PushOne([]byte("A"))
 	packet := buffer.PopOne()
 	assert(string(packet), "==", "A")
-	assert(*buffer.nextWriteFrom, "==", uint32(3)) // stored "A"
-	assert(buffer.nextReadFrom, "==", uint32(3))   // "A" already read
-	assert(*buffer.lastReadTo, "==", uint32(0))    // last read not committed yet
-	assert(*buffer.wrapAt, "==", uint32(0))        // not wrapped around, do not need to update this
+	assert(buffer.nextWriteFrom.load(), "==", uint64(3)) // stored "A"
+	assert(buffer.nextReadFrom, "==", uint64(3))         // "A" already read
+	assert(buffer.lastReadTo.load(), "==", uint64(0))    // last read not committed yet
+	assert(buffer.wrapAt.load(), "==", uint64(0))        // not wrapped around, do not need to update this
 }
 
 func Test_push_pop_pop(t *testing.T) {
@@ -50,10 +54,10 @@ func Test_push_pop_pop(t *testing.T) {
 	assert(string(packet), "==", "A")
 	packet = buffer.PopOne()
 	assert(packet, "==", nil)
-	assert(*buffer.nextWriteFrom, "==", uint32(3)) // stored "A"
-	assert(buffer.nextReadFrom, "==", uint32(3))   // "A" already read
-	assert(*buffer.lastReadTo, "==", uint32(3))    // last read is committed now
-	assert(*buffer.wrapAt, "==", uint32(0))        // not wrapped around, do not need to update this
+	assert(buffer.nextWriteFrom.load(), "==", uint64(3)) // stored "A"
+	assert(buffer.nextReadFrom, "==", uint64(3))         // "A" already read
+	assert(buffer.lastReadTo.load(), "==", uint64(3))    // last read is committed now
+	assert(buffer.wrapAt.load(), "==", uint64(0))        // not wrapped around, do not need to update this
 }
 
 func Test_pushN_popN(t *testing.T) {
@@ -67,10 +71,10 @@ func Test_pushN_popN(t *testing.T) {
 	assert(len(packets), "==", 2)
 	assert(string(packets[0]), "==", "A")
 	assert(string(packets[1]), "==", "B")
-	assert(*buffer.nextWriteFrom, "==", uint32(6)) // stored "A", "B"
-	assert(buffer.nextReadFrom, "==", uint32(6))   // "A", "B" already read
-	assert(*buffer.lastReadTo, "==", uint32(0))    // last read not committed yet
-	assert(*buffer.wrapAt, "==", uint32(0))        // not wrapped around, do not need to update this
+	assert(buffer.nextWriteFrom.load(), "==", uint64(6)) // stored "A", "B"
+	assert(buffer.nextReadFrom, "==", uint64(6))         // "A", "B" already read
+	assert(buffer.lastReadTo.load(), "==", uint64(0))    // last read not committed yet
+	assert(buffer.wrapAt.load(), "==", uint64(0))        // not wrapped around, do not need to update this
 }
 
 func Test_push_wrapped(t *testing.T) {
@@ -81,12 +85,12 @@ func Test_push_wrapped(t *testing.T) {
 		[]byte("B"),
 		[]byte("C"),
 	})
-	assert(*buffer.nextWriteFrom, "==", uint32(9)) // stored "A", "B", "C"
-	buffer.PopN(1024)                              // move nextReadFrom
-	buffer.PopN(1024)                              // move lastReadTo
+	assert(buffer.nextWriteFrom.load(), "==", uint64(9)) // stored "A", "B", "C"
+	buffer.PopN(1024)                                    // move nextReadFrom
+	buffer.PopN(1024)                                    // move lastReadTo
 	buffer.PushOne([]byte("DD"))
-	assert(*buffer.nextWriteFrom, "==", uint32(4)) // overwrite "A", "B", stored "C", "DD"
-	assert(*buffer.wrapAt, "==", uint32(9))        // wrap at 9 not 10, leave a marker for read to catch up
+	assert(buffer.nextWriteFrom.load(), "==", uint64(4)) // overwrite "A", "B", stored "C", "DD"
+	assert(buffer.wrapAt.load(), "==", uint64(9))        // wrap at 9 not 10, leave a marker for read to catch up
 	assert(buffer.data, "==", []byte{
 		2, 0, byte('D'), byte('D'), // 4th packet
 		0, byte('B'), // 2nd packet, partially overwrite
@@ -102,10 +106,10 @@ func Test_push_should_not_override_lastReadTo_after_wrap(t *testing.T) {
 	buffer.PopOne()
 	buffer.PushOne([]byte("B"))
 	buffer.PopOne()
-	assert(*buffer.nextWriteFrom, "==", uint32(6))
-	assert(buffer.nextReadFrom, "==", uint32(6))
-	assert(*buffer.lastReadTo, "==", uint32(3))
-	assert(*buffer.wrapAt, "==", uint32(0))
+	assert(buffer.nextWriteFrom.load(), "==", uint64(6))
+	assert(buffer.nextReadFrom, "==", uint64(6))
+	assert(buffer.lastReadTo.load(), "==", uint64(3))
+	assert(buffer.wrapAt.load(), "==", uint64(0))
 	assert(buffer.data, "==", []byte{
 		1, 0, byte('A'), // 1st packet
 		1, 0, byte('B'), // 2nd packet <-- lastReadTo
@@ -113,16 +117,20 @@ func Test_push_should_not_override_lastReadTo_after_wrap(t *testing.T) {
 	})
 	buffer.PushOne([]byte("C"))
 	buffer.PushOne([]byte("DD"))
-	assert(*buffer.nextWriteFrom, "==", uint32(4))
-	assert(buffer.nextReadFrom, "==", uint32(0))
-	assert(*buffer.lastReadTo, "==", uint32(0)) // can not point to 3 as it is invalid region now
-	assert(*buffer.wrapAt, "==", uint32(0))
+	assert(buffer.nextWriteFrom.load(), "==", uint64(4))
+	assert(buffer.nextReadFrom, "==", uint64(6))
+	assert(buffer.lastReadTo.load(), "==", uint64(6)) // can not point to 3 as it is invalid region now
+	assert(buffer.wrapAt.load(), "==", uint64(9))
 	assert(buffer.data, "==", []byte{
-		2, 0, byte('D'), byte('D'), // 4th packet <-- lastReadTo
+		2, 0, byte('D'), byte('D'), // 4th packet
 		0, byte('B'), // 2nd packet, partially overwrite
-		1, 0, byte('C'), // 3th packet
+		1, 0, byte('C'), // 3th packet <-- lastReadTo
 		0, // excluded by wrap at pointer
 	})
+	packets := buffer.PopN(1024)
+	assert(len(packets), "==", 2)
+	assert(string(packets[0]), "==", "C")
+	assert(string(packets[1]), "==", "DD")
 }
 
 func Test_push_should_not_override_lastReadTo_before_wrap(t *testing.T) {
@@ -133,30 +141,30 @@ func Test_push_should_not_override_lastReadTo_before_wrap(t *testing.T) {
 	buffer.PushOne([]byte("BB"))
 	buffer.PopOne()
 	buffer.PopOne()
-	assert(*buffer.nextWriteFrom, "==", uint32(7))
-	assert(buffer.nextReadFrom, "==", uint32(7))
-	assert(*buffer.lastReadTo, "==", uint32(7))
-	assert(*buffer.wrapAt, "==", uint32(0))
+	assert(buffer.nextWriteFrom.load(), "==", uint64(7))
+	assert(buffer.nextReadFrom, "==", uint64(7))
+	assert(buffer.lastReadTo.load(), "==", uint64(7))
+	assert(buffer.wrapAt.load(), "==", uint64(0))
 	assert(buffer.data, "==", []byte{
 		1, 0, byte('A'), // 1st packet
 		2, 0, byte('B'), byte('B'), // 2nd packet
 		0, 0, 0, // not used yet
 	})
 	buffer.PushOne([]byte("CC"))
-	assert(*buffer.nextWriteFrom, "==", uint32(4))
-	assert(buffer.nextReadFrom, "==", uint32(7))
-	assert(*buffer.lastReadTo, "==", uint32(7)) // still not overwrite yet
-	assert(*buffer.wrapAt, "==", uint32(7))
+	assert(buffer.nextWriteFrom.load(), "==", uint64(4))
+	assert(buffer.nextReadFrom, "==", uint64(7))
+	assert(buffer.lastReadTo.load(), "==", uint64(7)) // still not overwrite yet
+	assert(buffer.wrapAt.load(), "==", uint64(7))
 	assert(buffer.data, "==", []byte{
 		2, 0, byte('C'), byte('C'), // 3rd packet
 		0, byte('B'), byte('B'), // 2nd packet
 		0, 0, 0,
 	})
 	buffer.PushOne([]byte("E"))
-	assert(*buffer.nextWriteFrom, "==", uint32(7))
-	assert(buffer.nextReadFrom, "==", uint32(0))
-	assert(*buffer.lastReadTo, "==", uint32(0)) // index 3 was overwritten
-	assert(*buffer.wrapAt, "==", uint32(0))
+	assert(buffer.nextWriteFrom.load(), "==", uint64(7))
+	assert(buffer.nextReadFrom, "==", uint64(0))
+	assert(buffer.lastReadTo.load(), "==", uint64(0)) // index 3 was overwritten
+	assert(buffer.wrapAt.load(), "==", uint64(0))
 }
 
 func Test_pop_should_follow_wrapAt(t *testing.T) {
@@ -168,10 +176,10 @@ func Test_pop_should_follow_wrapAt(t *testing.T) {
 	buffer.PushOne([]byte("B"))
 	buffer.PushOne([]byte("C"))
 	buffer.PushOne([]byte("D"))
-	assert(*buffer.nextWriteFrom, "==", uint32(3))
-	assert(buffer.nextReadFrom, "==", uint32(4))
-	assert(*buffer.lastReadTo, "==", uint32(4))
-	assert(*buffer.wrapAt, "==", uint32(10))
+	assert(buffer.nextWriteFrom.load(), "==", uint64(3))
+	assert(buffer.nextReadFrom, "==", uint64(4))
+	assert(buffer.lastReadTo.load(), "==", uint64(4))
+	assert(buffer.wrapAt.load(), "==", uint64(10))
 	packets := buffer.PopN(1024)
 	assert(len(packets), "==", 3)
 }
@@ -184,27 +192,27 @@ func Test_wrap_then_push_pop_pop(t *testing.T) {
 		[]byte("B"),
 		[]byte("C"),
 	})
-	assert(*buffer.nextWriteFrom, "==", uint32(9)) // stored "A", "B", "C"
-	buffer.PopN(1024)                              // move nextReadFrom
-	buffer.PopN(1024)                              // move lastReadTo
+	assert(buffer.nextWriteFrom.load(), "==", uint64(9)) // stored "A", "B", "C"
+	buffer.PopN(1024)                                    // move nextReadFrom
+	buffer.PopN(1024)                                    // move lastReadTo
 	buffer.PushOne([]byte("DD"))
-	assert(*buffer.nextWriteFrom, "==", uint32(4)) // overwrite "A", "B", stored "C", "DD"
-	assert(*buffer.wrapAt, "==", uint32(9))        // wrap at 9 not 10, leave a marker for read to catch up
-	assert(buffer.nextReadFrom, "==", uint32(9))
+	assert(buffer.nextWriteFrom.load(), "==", uint64(4)) // overwrite "A", "B", stored "C", "DD"
+	assert(buffer.wrapAt.load(), "==", uint64(9))        // wrap at 9 not 10, leave a marker for read to catch up
+	assert(buffer.nextReadFrom, "==", uint64(9))
 	buffer.PushOne([]byte(""))
-	assert(buffer.nextReadFrom, "==", uint32(9))
-	assert(*buffer.lastReadTo, "==", uint32(9))
-	assert(*buffer.wrapAt, "==", uint32(9))
+	assert(buffer.nextReadFrom, "==", uint64(9))
+	assert(buffer.lastReadTo.load(), "==", uint64(9))
+	assert(buffer.wrapAt.load(), "==", uint64(9))
 	packets := buffer.PopN(1024)
 	assert(len(packets), "==", 2)
-	assert(buffer.nextReadFrom, "==", uint32(6))
-	assert(*buffer.lastReadTo, "==", uint32(9))
-	assert(*buffer.wrapAt, "==", uint32(9))
+	assert(buffer.nextReadFrom, "==", uint64(6))
+	assert(buffer.lastReadTo.load(), "==", uint64(9))
+	assert(buffer.wrapAt.load(), "==", uint64(9))
 	packets = buffer.PopN(1024)
 	assert(len(packets), "==", 0)
-	assert(buffer.nextReadFrom, "==", uint32(6))
-	assert(*buffer.lastReadTo, "==", uint32(6))
-	assert(*buffer.wrapAt, "==", uint32(9)) // wrapAt reset to 0, otherwise it will overflow
+	assert(buffer.nextReadFrom, "==", uint64(6))
+	assert(buffer.lastReadTo.load(), "==", uint64(6))
+	assert(buffer.wrapAt.load(), "==", uint64(9)) // wrapAt reset to 0, otherwise it will overflow
 	packets = buffer.PopN(1024)
 	assert(len(packets), "==", 0)
 }
@@ -223,6 +231,278 @@ func Test_random_push_pop(t *testing.T) {
 	}
 }
 
+func Test_checksummed_record(t *testing.T) {
+	assert := NewAssert(t)
+	buffer := newBufferOfVersion(2, 20)
+	buffer.PushOne([]byte("A"))
+	assert(buffer.nextWriteFrom.load(), "==", uint64(7)) // 2 bytes size, 4 bytes crc32c and "A"
+	assert(buffer.data[:2], "==", []byte{1, 0})
+	assert(binary.LittleEndian.Uint32(buffer.data[2:]), "==", crc32.Checksum([]byte{1, 0, 'A'}, castagnoliTable))
+	packets, err := buffer.PopNChecked(1024)
+	assert(err, "==", nil)
+	assert(len(packets), "==", 1)
+	assert(string(packets[0]), "==", "A")
+}
+
+func Test_pop_should_skip_corrupted_record(t *testing.T) {
+	assert := NewAssert(t)
+	buffer := newBufferOfVersion(2, 30)
+	buffer.PushN([][]byte{
+		[]byte("A"),
+		[]byte("B"),
+		[]byte("C"),
+	})
+	buffer.data[7+6] = byte('X') // flip payload of "B"
+	packets, err := buffer.PopNChecked(1024)
+	assert(len(packets), "==", 1)
+	assert(string(packets[0]), "==", "A")
+	corruption, ok := err.(*CorruptionError)
+	assert(ok, "==", true)
+	assert(corruption.Offset, "==", uint64(7))
+	assert(corruption.Skipped, "==", uint64(7))
+	assert(corruption.Reason, "==", "checksum mismatch")
+	packets, err = buffer.PopNChecked(1024)
+	assert(err, "==", nil)
+	assert(len(packets), "==", 1)
+	assert(string(packets[0]), "==", "C")
+}
+
+func Test_pop_should_not_follow_corrupted_size(t *testing.T) {
+	assert := NewAssert(t)
+	buffer := newBufferOfVersion(2, 30)
+	buffer.PushN([][]byte{
+		[]byte("A"),
+		[]byte("B"),
+	})
+	buffer.data[0] = 0xff // size of "A" points beyond the written region
+	packets, err := buffer.PopNChecked(1024)
+	assert(len(packets), "==", 0)
+	assert(err.(*CorruptionError).Skipped, "==", uint64(7))
+	assert(buffer.nextReadFrom, "==", uint64(7))
+	packets, err = buffer.PopNChecked(1024)
+	assert(err, "==", nil)
+	assert(len(packets), "==", 1)
+	assert(string(packets[0]), "==", "B")
+}
+
+func Test_unchecksummed_corruption_skips_region(t *testing.T) {
+	assert := NewAssert(t)
+	buffer := newBuffer(10)
+	buffer.PushN([][]byte{
+		[]byte("A"),
+		[]byte("B"),
+	})
+	buffer.data[0] = 0xff
+	packets := buffer.PopN(1024)
+	assert(len(packets), "==", 0)
+	assert(buffer.nextReadFrom, "==", uint64(6))
+}
+
+func Test_push_too_large(t *testing.T) {
+	assert := NewAssert(t)
+	buffer := newBuffer(10)
+	err := buffer.Push(make([]byte, 9))
+	assert(errors.Is(err, ErrPacketTooLarge), "==", true)
+	assert(buffer.nextWriteFrom.load(), "==", uint64(0))
+	assert(buffer.Push(make([]byte, 8)), "==", nil)
+	buffer = newBuffer(math.MaxUint16 + 10)
+	assert(errors.Is(buffer.Push(make([]byte, math.MaxUint16+1)), ErrPacketTooLarge), "==", true)
+}
+
+func Test_push_batch_stops_at_too_large(t *testing.T) {
+	assert := NewAssert(t)
+	buffer := newBuffer(10)
+	n, err := buffer.PushBatch([][]byte{
+		[]byte("A"),
+		make([]byte, 9),
+		[]byte("B"),
+	})
+	assert(n, "==", 1)
+	assert(errors.Is(err, ErrPacketTooLarge), "==", true)
+	packets := buffer.PopN(1024)
+	assert(len(packets), "==", 1)
+	assert(string(packets[0]), "==", "A")
+}
+
+func Test_push_pop_large_packet(t *testing.T) {
+	assert := NewAssert(t)
+	buffer := newBufferOfVersion(3, 3*1024*1024)
+	large := make([]byte, 2*1024*1024)
+	rand.Read(large)
+	assert(buffer.Push(large), "==", nil)
+	assert(buffer.nextWriteFrom.load(), "==", uint64(8+len(large))) // 4 bytes size, 4 bytes crc32c
+	packets, err := buffer.PopNChecked(1024)
+	assert(err, "==", nil)
+	assert(len(packets), "==", 1)
+	assert(packets[0], "==", large)
+}
+
+func Test_version_2_still_limited_to_uint16(t *testing.T) {
+	assert := NewAssert(t)
+	buffer := newBufferOfVersion(2, math.MaxUint16+100)
+	assert(errors.Is(buffer.Push(make([]byte, math.MaxUint16+1)), ErrPacketTooLarge), "==", true)
+	assert(buffer.Push(make([]byte, math.MaxUint16)), "==", nil)
+}
+
+func Test_zeroed_meta_is_version_1(t *testing.T) {
+	assert := NewAssert(t)
+	meta := make([]byte, META_SECTION_SIZE)
+	buffer := NewRingBuffer(meta, make([]byte, 30))
+	assert(meta[0], "==", byte(1))
+	buffer.PushOne([]byte("A"))
+	assert(string(buffer.PopOne()), "==", "A")
+}
+
+func Test_wide_meta_section(t *testing.T) {
+	assert := NewAssert(t)
+	meta := make([]byte, WIDE_META_SECTION_SIZE)
+	meta[0] = 4
+	buffer := NewRingBuffer(meta, make([]byte, 30))
+	buffer.PushOne([]byte("A"))
+	buffer.PopN(1024)
+	buffer.PopN(1024)
+	assert(binary.LittleEndian.Uint64(meta[8:]), "==", uint64(9))  // nextWriteFrom
+	assert(binary.LittleEndian.Uint64(meta[16:]), "==", uint64(9)) // lastReadTo
+	assert(binary.LittleEndian.Uint64(meta[24:]), "==", uint64(0)) // wrapAt
+}
+
+func Test_push_after_caught_up_should_not_replay(t *testing.T) {
+	assert := NewAssert(t)
+	buffer := newBuffer(10)
+	buffer.PushN([][]byte{
+		[]byte("A"),
+		[]byte("B"),
+		[]byte("C"),
+	})
+	buffer.PopN(1024)
+	buffer.PopN(1024)
+	buffer.PushOne([]byte("DD"))
+	assert(len(buffer.PopN(1024)), "==", 1)
+	assert(len(buffer.PopN(1024)), "==", 0)
+	assert(buffer.wrapAt.load(), "==", uint64(9))
+	buffer.PushOne([]byte("E"))
+	packets := buffer.PopN(1024)
+	assert(len(packets), "==", 1)
+	assert(string(packets[0]), "==", "E")
+	assert(buffer.DroppedPackets(), "==", uint64(0))
+}
+
+func Test_overwrite_oldest_counts_dropped(t *testing.T) {
+	assert := NewAssert(t)
+	buffer := newBuffer(10)
+	buffer.PushN([][]byte{
+		[]byte("A"),
+		[]byte("B"),
+		[]byte("C"),
+	})
+	buffer.PushOne([]byte("DD")) // "A", "B" are overwritten, "C" is kept
+	assert(buffer.DroppedPackets(), "==", uint64(2))
+	packets := buffer.PopN(1024)
+	assert(len(packets), "==", 2)
+	assert(string(packets[0]), "==", "C")
+	assert(string(packets[1]), "==", "DD")
+}
+
+func Test_overwrite_oldest_does_not_count_read_packets(t *testing.T) {
+	assert := NewAssert(t)
+	buffer := newBuffer(10)
+	buffer.PushOne([]byte("A"))
+	buffer.PopOne()
+	buffer.PushOne([]byte("BB"))
+	buffer.PopOne()
+	buffer.PopOne()
+	buffer.PushOne([]byte("CC"))
+	buffer.PushOne([]byte("E")) // lastReadTo at the end of previous lap is moved to 0
+	assert(buffer.DroppedPackets(), "==", uint64(0))
+	packets := buffer.PopN(1024)
+	assert(len(packets), "==", 2)
+	assert(string(packets[0]), "==", "CC")
+	assert(string(packets[1]), "==", "E")
+}
+
+func Test_overwrite_oldest_does_not_redeliver_popped_packets(t *testing.T) {
+	assert := NewAssert(t)
+	buffer := newBuffer(10)
+	buffer.PushN([][]byte{
+		[]byte("A"),
+		[]byte("B"),
+		[]byte("C"),
+	})
+	batch, _ := buffer.Pop(2)
+	buffer.PushOne([]byte("DD")) // "A", "B" are overwritten after being popped
+	assert(batch.Commit(), "==", ErrStaleBatch)
+	assert(buffer.DroppedPackets(), "==", uint64(0))
+	packets := buffer.PopN(1024)
+	assert(len(packets), "==", 2)
+	assert(string(packets[0]), "==", "C")
+	assert(string(packets[1]), "==", "DD")
+}
+
+func Test_reject_newest_when_full(t *testing.T) {
+	assert := NewAssert(t)
+	buffer := newBuffer(10)
+	buffer.overflowPolicy = RejectNewest
+	n, err := buffer.PushBatch([][]byte{
+		[]byte("A"),
+		[]byte("B"),
+		[]byte("C"),
+		[]byte("DD"),
+	})
+	assert(n, "==", 3)
+	assert(err, "==", ErrFull)
+	assert(buffer.nextWriteFrom.load(), "==", uint64(9))
+	assert(buffer.wrapAt.load(), "==", uint64(0))
+	packets := buffer.PopN(2)
+	assert(len(packets), "==", 2)
+	assert(buffer.Push([]byte("DD")), "==", ErrFull) // "A" and "B" not committed yet
+	buffer.PopN(0)
+	assert(buffer.Push([]byte("DD")), "==", nil)
+	packets = buffer.PopN(1024)
+	assert(len(packets), "==", 2)
+	assert(string(packets[0]), "==", "C")
+	assert(string(packets[1]), "==", "DD")
+	assert(buffer.DroppedPackets(), "==", uint64(0))
+}
+
+func Test_sequence_numbers(t *testing.T) {
+	assert := NewAssert(t)
+	buffer := newBufferOfVersion(5, 60)
+	sequence, err := buffer.PushWithSequence([]byte("A"))
+	assert(err, "==", nil)
+	assert(sequence, "==", uint64(1))
+	sequence, _ = buffer.PushWithSequence([]byte("B"))
+	assert(sequence, "==", uint64(2))
+	batch, _ := buffer.Pop(10)
+	assert(batch.Sequences, "==", []uint64{1, 2})
+	batch.Commit()
+	buffer.PushN([][]byte{
+		[]byte("C"),
+		[]byte("D"),
+		[]byte("E"), // wraps around and overwrites "C"
+	})
+	batch, _ = buffer.Pop(10)
+	assert(len(batch.Packets), "==", 2)
+	// "C" is dropped, the gap tells
+	assert(batch.Sequences, "==", []uint64{4, 5})
+	assert(buffer.lastSequence.load(), "==", uint64(5))
+}
+
+func Test_sequence_numbers_before_version_5(t *testing.T) {
+	assert := NewAssert(t)
+	buffer := newBufferOfVersion(4, 60)
+	sequence, err := buffer.PushWithSequence([]byte("A"))
+	assert(err, "==", nil)
+	assert(sequence, "==", uint64(0))
+	batch, _ := buffer.Pop(10)
+	assert(batch.Sequences, "==", []uint64{0})
+}
+
 func newBuffer(size int) *ringBuffer {
 	return NewRingBuffer(make([]byte, META_SECTION_SIZE), make([]byte, size))
 }
+
+func newBufferOfVersion(version uint32, size int) *ringBuffer {
+	meta := make([]byte, metaSectionSize(version))
+	meta[0] = byte(version)
+	return NewRingBuffer(meta, make([]byte, size))
+}
@@ -0,0 +1,94 @@
+package drbuffer
+
+import "context"
+
+// Packets delivers copies of the popped packets one by one, the packet is committed once received.
+// the channel is closed when the context is done, the buffer is closed or the consumer is removed,
+// a packet popped but not received by then is popped again by the next pop, or after reopen
+func (consumer *durableConsumer) Packets(ctx context.Context) <-chan []byte {
+	packets := make(chan []byte)
+	go func() {
+		defer close(packets)
+		for {
+			popped, err := consumer.popWait(ctx, 1, true)
+			if len(popped) == 0 {
+				if _, corrupted := err.(*CorruptionError); corrupted {
+					// the corrupted records are skipped already
+					continue
+				}
+				return
+			}
+			select {
+			case packets <- popped[0]:
+			case <-ctx.Done():
+				consumer.abandon()
+				return
+			case <-consumer.buffer.done:
+				return
+			}
+			if consumer.Commit() != nil {
+				return
+			}
+		}
+	}()
+	return packets
+}
+
+// abandon moves the consumer back to the packet popped but not delivered, so the next pop does not commit it
+func (consumer *durableConsumer) abandon() {
+	consumer.buffer.lock.Lock()
+	defer consumer.buffer.lock.Unlock()
+	if consumer.checkUsable() != nil {
+		return
+	}
+	cursor := consumer.cursor
+	cursor.nextReadFrom = cursor.lastReadTo.load()
+	cursor.rewinds += 1
+	cursor.pendingCounted = false
+}
+
+// Sink pushes the packets sent to the returned channel, until the channel is closed by the sender.
+// it stops pushing when the context is done, the buffer is closed or a push fails, a push waiting for space gives up with the context.
+// the reason is sent to the error channel and the packets sent after are discarded until the context is done.
+// the error channel is closed once the packet channel is closed or the context is done
+func (buffer *durableRingBuffer) Sink(ctx context.Context) (chan<- []byte, <-chan error) {
+	packets := make(chan []byte)
+	errs := make(chan error, 1)
+	go func() {
+		defer close(errs)
+		for {
+			var err error
+			select {
+			case packet, ok := <-packets:
+				if !ok {
+					return
+				}
+				_, err = buffer.pushContext(ctx, packet)
+			case <-ctx.Done():
+				err = ctx.Err()
+			case <-buffer.done:
+				err = ErrClosed
+			}
+			if err != nil {
+				errs <- err
+				buffer.discard(ctx, packets)
+				return
+			}
+		}
+	}()
+	return packets, errs
+}
+
+// discard drains the packets of a stopped Sink, so the sender does not block
+func (buffer *durableRingBuffer) discard(ctx context.Context, packets chan []byte) {
+	for {
+		select {
+		case _, ok := <-packets:
+			if !ok {
+				return
+			}
+		case <-ctx.Done():
+			return
+		}
+	}
+}
@@ -0,0 +1,133 @@
+package drbuffer
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func Test_packets_channel_commits_delivered_packets(t *testing.T) {
+	assert := NewAssert(t)
+	assert(ensureFileNotExist("/tmp/drbuffer_channel"), "==", nil)
+	buffer, err := Open("/tmp/drbuffer_channel", 1)
+	assert(err, "==", nil)
+	buffer.PushN([][]byte{
+		[]byte("A"),
+		[]byte("B"),
+		[]byte("C"),
+	})
+	ctx, cancel := context.WithCancel(context.Background())
+	packets := buffer.Packets(ctx)
+	assert(string(<-packets), "==", "A")
+	assert(string(<-packets), "==", "B")
+	cancel()
+	delivered := 2
+	for range packets {
+		// C may be received before the channel is closed
+		delivered += 1
+	}
+	assert(buffer.Close(), "==", nil)
+	buffer, err = Open("/tmp/drbuffer_channel", 1)
+	assert(err, "==", nil)
+	defer buffer.Close()
+	assert(len(buffer.PopN(10)), "==", 3-delivered)
+}
+
+func Test_packets_channel_closed_with_buffer(t *testing.T) {
+	assert := NewAssert(t)
+	assert(ensureFileNotExist("/tmp/drbuffer_channel"), "==", nil)
+	buffer, err := Open("/tmp/drbuffer_channel", 1)
+	assert(err, "==", nil)
+	packets := buffer.Packets(context.Background())
+	buffer.PushOne([]byte("A"))
+	packet := <-packets
+	buffer.PushOne([]byte("B"))
+	assert(buffer.Close(), "==", nil)
+	for range packets {
+	}
+	// the received packet is a copy, still valid after munmap
+	assert(string(packet), "==", "A")
+}
+
+func Test_sink_pushes_until_closed(t *testing.T) {
+	assert := NewAssert(t)
+	assert(ensureFileNotExist("/tmp/drbuffer_channel"), "==", nil)
+	buffer, err := Open("/tmp/drbuffer_channel", 1)
+	assert(err, "==", nil)
+	sink, errs := buffer.Sink(context.Background())
+	sink <- []byte("A")
+	sink <- []byte("B")
+	close(sink)
+	assert(<-errs, "==", nil)
+	packets := buffer.PopN(10)
+	assert(len(packets), "==", 2)
+	assert(string(packets[1]), "==", "B")
+	sink, errs = buffer.Sink(context.Background())
+	assert(buffer.Close(), "==", nil)
+	assert(<-errs, "==", ErrClosed)
+	// discarded after stopped
+	sink <- []byte("C")
+	close(sink)
+}
+
+func Test_sink_stops_when_context_is_done(t *testing.T) {
+	assert := NewAssert(t)
+	assert(ensureFileNotExist("/tmp/drbuffer_channel"), "==", nil)
+	buffer, err := Open("/tmp/drbuffer_channel", 1)
+	assert(err, "==", nil)
+	defer buffer.Close()
+	ctx, cancel := context.WithCancel(context.Background())
+	sink, errs := buffer.Sink(ctx)
+	cancel()
+	assert(<-errs, "==", context.Canceled)
+	// returns without waiting for the sender to close the channel
+	_, open := <-errs
+	assert(open, "==", false)
+	close(sink)
+}
+
+func Test_sink_push_waiting_for_space_stops_with_context(t *testing.T) {
+	assert := NewAssert(t)
+	assert(ensureFileNotExist("/tmp/drbuffer_channel"), "==", nil)
+	buffer, err := Open("/tmp/drbuffer_channel", 1, WithOverflowPolicy(BlockUntilSpace))
+	assert(err, "==", nil)
+	defer buffer.Close()
+	ctx, cancel := context.WithCancel(context.Background())
+	sink, errs := buffer.Sink(ctx)
+	sink <- make([]byte, 600)
+	sink <- make([]byte, 600) // blocks until the first one is popped
+	time.Sleep(10 * time.Millisecond)
+	cancel()
+	assert(<-errs, "==", context.Canceled)
+	_, open := <-errs
+	assert(open, "==", false)
+	assert(buffer.Stats().TotalPushed, "==", uint64(1))
+}
+
+func Test_packets_channel_cancelled_keeps_packet_not_received(t *testing.T) {
+	assert := NewAssert(t)
+	assert(ensureFileNotExist("/tmp/drbuffer_channel"), "==", nil)
+	buffer, err := Open("/tmp/drbuffer_channel", 1)
+	assert(err, "==", nil)
+	defer buffer.Close()
+	buffer.PushN([][]byte{
+		[]byte("A"),
+		[]byte("B"),
+		[]byte("C"),
+	})
+	ctx, cancel := context.WithCancel(context.Background())
+	packets := buffer.Packets(ctx)
+	assert(string(<-packets), "==", "A")
+	// B is popped while waiting to be received
+	time.Sleep(10 * time.Millisecond)
+	cancel()
+	received := []string{"A"}
+	for packet := range packets {
+		// B may be received before the channel is closed
+		received = append(received, string(packet))
+	}
+	for _, packet := range buffer.PopN(10) {
+		received = append(received, string(packet))
+	}
+	assert(received, "==", []string{"A", "B", "C"})
+}
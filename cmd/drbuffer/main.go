@@ -0,0 +1,274 @@
+// Command drbuffer looks inside and feeds buffer files
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/hex"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"os/signal"
+	"time"
+
+	"github.com/dulumao/drbuffer"
+)
+
+const usage = `usage: drbuffer <command> [flags] FILE
+
+commands:
+  inspect  print the meta section
+  dump     print the pending packets without popping them
+  tail     print the packets pushed from now on, until interrupted
+  push     push every line of stdin
+  pop      pop the pending packets to stdout, one per line
+  verify   check the pending records without changing the file, exits with 1 if anything to repair
+  repair   move the meta pointers back to the last valid record
+`
+
+// TAIL_POLL_INTERVAL is how often tail looks for new packets
+const TAIL_POLL_INTERVAL = 100 * time.Millisecond
+
+func main() {
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer stop()
+	os.Exit(run(ctx, os.Args[1:], os.Stdin, os.Stdout, os.Stderr))
+}
+
+func run(ctx context.Context, args []string, stdin io.Reader, stdout io.Writer, stderr io.Writer) int {
+	if len(args) == 0 {
+		fmt.Fprint(stderr, usage)
+		return 2
+	}
+	command, args := args[0], args[1:]
+	flags := flag.NewFlagSet(command, flag.ContinueOnError)
+	flags.SetOutput(stderr)
+	format := flags.String("format", "text", "packet format: text, hex or json")
+	var commandFunc func(filePath string) error
+	switch command {
+	case "inspect":
+		commandFunc = func(filePath string) error {
+			return inspect(filePath, stdout)
+		}
+	case "dump":
+		oldest := flags.Bool("oldest", false, "start from the oldest packet not committed by every consumer")
+		commandFunc = func(filePath string) error {
+			return dump(filePath, *oldest, *format, stdout)
+		}
+	case "tail":
+		commandFunc = func(filePath string) error {
+			return tail(ctx, filePath, *format, stdout)
+		}
+	case "push":
+		nkiloBytes := flags.Int("size", 1024, "kilobytes for packets, if the file is created")
+		commandFunc = func(filePath string) error {
+			return push(filePath, *nkiloBytes, stdin)
+		}
+	case "pop":
+		count := flags.Int("n", 0, "pop at most n packets, 0 pops all")
+		consumer := flags.String("consumer", "", "pop as the named consumer")
+		commandFunc = func(filePath string) error {
+			return pop(filePath, *consumer, *count, *format, stdout)
+		}
+	case "verify":
+		commandFunc = func(filePath string) error {
+			report, err := drbuffer.Verify(filePath)
+			if err != nil {
+				return err
+			}
+			printReport(stdout, report)
+			if report.Repaired() || len(report.Skipped) > 0 {
+				return fmt.Errorf("%d anomalies found", len(report.Repairs)+len(report.Skipped))
+			}
+			return nil
+		}
+	case "repair":
+		commandFunc = func(filePath string) error {
+			if err := checkExists(filePath); err != nil {
+				return err
+			}
+			report, err := drbuffer.Repair(filePath)
+			printReport(stdout, report)
+			return err
+		}
+	default:
+		fmt.Fprintf(stderr, "unknown command: %s\n%s", command, usage)
+		return 2
+	}
+	if err := flags.Parse(args); err != nil {
+		return 2
+	}
+	if flags.NArg() != 1 {
+		fmt.Fprint(stderr, usage)
+		return 2
+	}
+	if *format != "text" && *format != "hex" && *format != "json" {
+		fmt.Fprintf(stderr, "unknown format: %s\n", *format)
+		return 2
+	}
+	if err := commandFunc(flags.Arg(0)); err != nil {
+		fmt.Fprintf(stderr, "drbuffer %s: %s\n", command, err.Error())
+		return 1
+	}
+	return 0
+}
+
+func inspect(filePath string, stdout io.Writer) error {
+	meta, err := drbuffer.ReadMeta(filePath)
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(stdout, "version: %d\n", meta.Version)
+	fmt.Fprintf(stdout, "data size: %d\n", meta.DataSize)
+	fmt.Fprintf(stdout, "nextWriteFrom: %d\n", meta.NextWriteFrom)
+	fmt.Fprintf(stdout, "lastReadTo: %d\n", meta.LastReadTo)
+	fmt.Fprintf(stdout, "wrapAt: %d\n", meta.WrapAt)
+	fmt.Fprintf(stdout, "lastSequence: %d\n", meta.LastSequence)
+	for _, consumer := range meta.Consumers {
+		fmt.Fprintf(stdout, "consumer %s: lastReadTo %d, popped %d, dropped %d\n", consumer.Name, consumer.LastReadTo, consumer.PoppedPackets, consumer.DroppedPackets)
+	}
+	stats := meta.Stats
+	fmt.Fprintf(stdout, "pending: %d packets, %d bytes\n", stats.PendingPackets, stats.PendingBytes)
+	fmt.Fprintf(stdout, "free: %d bytes\n", stats.FreeBytes)
+	fmt.Fprintf(stdout, "pushed: %d, popped: %d, dropped: %d, wraps: %d\n", stats.TotalPushed, stats.TotalPopped, stats.DroppedPackets, stats.Wraps)
+	return nil
+}
+
+func dump(filePath string, oldest bool, format string, stdout io.Writer) error {
+	buffer, err := drbuffer.Open(filePath, 0, drbuffer.WithRole(drbuffer.ReadOnly))
+	if err != nil {
+		return err
+	}
+	defer buffer.Close()
+	iterator := buffer.Iterator()
+	if oldest {
+		if err := iterator.Seek(drbuffer.SeekOldest, 0); err != nil {
+			return err
+		}
+	}
+	for packet := range iterator.All() {
+		if err := writePacket(stdout, format, packet); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func tail(ctx context.Context, filePath string, format string, stdout io.Writer) error {
+	buffer, err := drbuffer.Open(filePath, 0, drbuffer.WithRole(drbuffer.ReadOnly))
+	if err != nil {
+		return err
+	}
+	defer buffer.Close()
+	iterator := buffer.Iterator()
+	if err := iterator.Seek(drbuffer.SeekNewest, 0); err != nil {
+		return err
+	}
+	for {
+		for packet := range iterator.All() {
+			if err := writePacket(stdout, format, packet); err != nil {
+				return err
+			}
+		}
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-time.After(TAIL_POLL_INTERVAL):
+		}
+	}
+}
+
+func push(filePath string, nkiloBytes int, stdin io.Reader) error {
+	buffer, err := drbuffer.Open(filePath, nkiloBytes)
+	if err != nil {
+		return err
+	}
+	defer buffer.Close()
+	scanner := bufio.NewScanner(stdin)
+	scanner.Buffer(make([]byte, 64*1024), 64*1024*1024)
+	for scanner.Scan() {
+		if err := buffer.Push(scanner.Bytes()); err != nil {
+			return err
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return err
+	}
+	return buffer.Flush()
+}
+
+func pop(filePath string, consumerName string, count int, format string, stdout io.Writer) error {
+	if err := checkExists(filePath); err != nil {
+		return err
+	}
+	buffer, err := drbuffer.Open(filePath, 0)
+	if err != nil {
+		return err
+	}
+	defer buffer.Close()
+	var consumer drbuffer.Consumer = buffer
+	if consumerName != "" {
+		if consumer, err = buffer.Consumer(consumerName); err != nil {
+			return err
+		}
+	}
+	for popped := 0; count == 0 || popped < count; {
+		maxPacketsCount := drbuffer.MAX_PACKETS_READ_ONE_TIME
+		if count != 0 && count-popped < maxPacketsCount {
+			maxPacketsCount = count - popped
+		}
+		packets, err := consumer.PopNChecked(maxPacketsCount)
+		if _, corrupted := err.(*drbuffer.CorruptionError); err != nil && !corrupted {
+			return err
+		}
+		if len(packets) == 0 && err == nil {
+			break
+		}
+		for _, packet := range packets {
+			if err := writePacket(stdout, format, packet); err != nil {
+				return err
+			}
+		}
+		popped += len(packets)
+	}
+	// only commit what has been written out
+	if err := consumer.Commit(); err != nil {
+		return err
+	}
+	return buffer.Flush()
+}
+
+// checkExists fails for a missing file, Open would create it. only push creates files
+func checkExists(filePath string) error {
+	_, err := os.Stat(filePath)
+	return err
+}
+
+func printReport(stdout io.Writer, report drbuffer.RecoveryReport) {
+	fmt.Fprintf(stdout, "pending packets: %d\n", report.PendingPackets)
+	fmt.Fprintf(stdout, "truncated bytes: %d\n", report.TruncatedBytes)
+	for _, skipped := range report.Skipped {
+		fmt.Fprintln(stdout, skipped.Error())
+	}
+	for _, repair := range report.Repairs {
+		fmt.Fprintln(stdout, repair)
+	}
+}
+
+func writePacket(stdout io.Writer, format string, packet []byte) error {
+	var err error
+	switch format {
+	case "hex":
+		_, err = fmt.Fprintln(stdout, hex.EncodeToString(packet))
+	case "json":
+		err = json.NewEncoder(stdout).Encode(struct {
+			Size   int    `json:"size"`
+			Packet []byte `json:"packet"`
+		}{len(packet), packet})
+	default:
+		_, err = fmt.Fprintf(stdout, "%s\n", packet)
+	}
+	return err
+}
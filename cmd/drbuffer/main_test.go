@@ -0,0 +1,150 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+func runCommand(t *testing.T, stdin string, args ...string) string {
+	stdout, stderr := &bytes.Buffer{}, &bytes.Buffer{}
+	if code := run(context.Background(), args, strings.NewReader(stdin), stdout, stderr); code != 0 {
+		t.Fatalf("%v exited with %d: %s", args, code, stderr.String())
+	}
+	return stdout.String()
+}
+
+func Test_push_dump_pop(t *testing.T) {
+	os.Remove("/tmp/drbuffer_cli")
+	runCommand(t, "Hello\nWorld\n", "push", "-size", "1", "/tmp/drbuffer_cli")
+	if dumped := runCommand(t, "", "dump", "/tmp/drbuffer_cli"); dumped != "Hello\nWorld\n" {
+		t.Fatalf("unexpected dump: %q", dumped)
+	}
+	if dumped := runCommand(t, "", "dump", "-format", "hex", "/tmp/drbuffer_cli"); dumped != "48656c6c6f\n576f726c64\n" {
+		t.Fatalf("unexpected hex dump: %q", dumped)
+	}
+	if dumped := runCommand(t, "", "dump", "-format", "json", "/tmp/drbuffer_cli"); !strings.HasPrefix(dumped, `{"size":5,"packet":"SGVsbG8="}`+"\n") {
+		t.Fatalf("unexpected json dump: %q", dumped)
+	}
+	if popped := runCommand(t, "", "pop", "-n", "1", "/tmp/drbuffer_cli"); popped != "Hello\n" {
+		t.Fatalf("unexpected pop: %q", popped)
+	}
+	if popped := runCommand(t, "", "pop", "/tmp/drbuffer_cli"); popped != "World\n" {
+		t.Fatalf("unexpected pop: %q", popped)
+	}
+	if popped := runCommand(t, "", "pop", "/tmp/drbuffer_cli"); popped != "" {
+		t.Fatalf("popped twice: %q", popped)
+	}
+	if dumped := runCommand(t, "", "dump", "-oldest", "/tmp/drbuffer_cli"); dumped != "" {
+		t.Fatalf("committed packets dumped: %q", dumped)
+	}
+}
+
+func Test_inspect(t *testing.T) {
+	os.Remove("/tmp/drbuffer_cli")
+	runCommand(t, "Hello\n", "push", "-size", "1", "/tmp/drbuffer_cli")
+	inspected := runCommand(t, "", "inspect", "/tmp/drbuffer_cli")
+	for _, line := range []string{"version: 5\n", "data size: 1024\n", "nextWriteFrom: 21\n", "lastSequence: 1\n", "pending: 1 packets, 21 bytes\n"} {
+		if !strings.Contains(inspected, line) {
+			t.Errorf("missing %q in:\n%s", line, inspected)
+		}
+	}
+}
+
+func Test_tail(t *testing.T) {
+	os.Remove("/tmp/drbuffer_cli")
+	runCommand(t, "Hello\n", "push", "-size", "1", "/tmp/drbuffer_cli")
+	ctx, cancel := context.WithCancel(context.Background())
+	stdout := &bytes.Buffer{}
+	done := make(chan int)
+	go func() {
+		done <- run(ctx, []string{"tail", "/tmp/drbuffer_cli"}, nil, stdout, os.Stderr)
+	}()
+	time.Sleep(50 * time.Millisecond)
+	runCommand(t, "World\n", "push", "/tmp/drbuffer_cli")
+	time.Sleep(3 * TAIL_POLL_INTERVAL)
+	cancel()
+	if code := <-done; code != 0 {
+		t.Fatal("tail exited with", code)
+	}
+	if stdout.String() != "World\n" {
+		t.Fatalf("unexpected tail: %q", stdout.String())
+	}
+}
+
+func Test_usage(t *testing.T) {
+	stderr := &bytes.Buffer{}
+	if code := run(context.Background(), []string{"unknown"}, nil, nil, stderr); code != 2 {
+		t.Fatal("unexpected exit code", code)
+	}
+	if code := run(context.Background(), []string{"dump"}, nil, nil, stderr); code != 2 {
+		t.Fatal("unexpected exit code", code)
+	}
+}
+
+func Test_verify_and_repair(t *testing.T) {
+	os.Remove("/tmp/drbuffer_cli")
+	runCommand(t, "Hello\nWorld\n", "push", "-size", "1", "/tmp/drbuffer_cli")
+	if verified := runCommand(t, "", "verify", "/tmp/drbuffer_cli"); verified != "pending packets: 2\ntruncated bytes: 0\n" {
+		t.Fatalf("unexpected verify: %q", verified)
+	}
+	file, err := os.OpenFile("/tmp/drbuffer_cli", os.O_RDWR, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	file.WriteAt([]byte("w"), 4096+21+16) // "World" corrupted
+	file.Close()
+	stdout := &bytes.Buffer{}
+	if code := run(context.Background(), []string{"verify", "/tmp/drbuffer_cli"}, nil, stdout, &bytes.Buffer{}); code != 1 {
+		t.Fatal("corrupted file verified, exit code", code)
+	}
+	if !strings.Contains(stdout.String(), "nextWriteFrom: 42 -> 21\n") {
+		t.Fatalf("unexpected verify: %q", stdout.String())
+	}
+	if repaired := runCommand(t, "", "repair", "/tmp/drbuffer_cli"); !strings.Contains(repaired, "nextWriteFrom: 42 -> 21\n") {
+		t.Fatalf("unexpected repair: %q", repaired)
+	}
+	runCommand(t, "", "verify", "/tmp/drbuffer_cli")
+}
+
+func Test_missing_file_not_created(t *testing.T) {
+	os.Remove("/tmp/drbuffer_cli")
+	for _, command := range []string{"pop", "repair"} {
+		if code := run(context.Background(), []string{command, "/tmp/drbuffer_cli"}, nil, &bytes.Buffer{}, &bytes.Buffer{}); code != 1 {
+			t.Fatalf("%s of missing file exited with %d", command, code)
+		}
+		if _, err := os.Stat("/tmp/drbuffer_cli"); !os.IsNotExist(err) {
+			t.Fatalf("%s created the file: %v", command, err)
+		}
+	}
+}
+
+func Test_corrupted_meta(t *testing.T) {
+	os.Remove("/tmp/drbuffer_cli")
+	runCommand(t, "Hello\n", "push", "-size", "1", "/tmp/drbuffer_cli")
+	file, err := os.OpenFile("/tmp/drbuffer_cli", os.O_RDWR, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	nextWriteFrom := make([]byte, 8)
+	binary.LittleEndian.PutUint64(nextWriteFrom, 1000000000)
+	file.WriteAt(nextWriteFrom, 8)
+	file.Close()
+	for _, command := range []string{"inspect", "dump", "verify"} {
+		stderr := &bytes.Buffer{}
+		if code := run(context.Background(), []string{command, "/tmp/drbuffer_cli"}, nil, &bytes.Buffer{}, stderr); code != 1 {
+			t.Fatalf("%s exited with %d", command, code)
+		}
+		if command != "verify" && !strings.Contains(stderr.String(), "meta section is corrupted: nextWriteFrom 1000000000 beyond data section of 1024 bytes") {
+			t.Fatalf("unexpected %s error: %q", command, stderr.String())
+		}
+	}
+	runCommand(t, "", "repair", "/tmp/drbuffer_cli")
+	if inspected := runCommand(t, "", "inspect", "/tmp/drbuffer_cli"); !strings.Contains(inspected, "pending: 1 packets, 21 bytes\n") {
+		t.Fatalf("unexpected inspect: %q", inspected)
+	}
+}
@@ -0,0 +1,90 @@
+package drbuffer
+
+import (
+	"encoding/binary"
+	"sync"
+	"testing"
+)
+
+func Test_concurrent_push_and_pop(t *testing.T) {
+	assert := NewAssert(t)
+	assert(ensureFileNotExist("/tmp/drbuffer_concurrent"), "==", nil)
+	buffer, err := Open("/tmp/drbuffer_concurrent", 4, WithCopiedPackets(), WithOverflowPolicy(BlockUntilSpace))
+	assert(err, "==", nil)
+	defer buffer.Close()
+	const producers = 8
+	const packetsPerProducer = 1000
+	pushers := sync.WaitGroup{}
+	for producer := 0; producer < producers; producer++ {
+		pushers.Add(1)
+		go func(producer int) {
+			defer pushers.Done()
+			for i := 0; i < packetsPerProducer; i++ {
+				packet := make([]byte, 8)
+				binary.LittleEndian.PutUint32(packet, uint32(producer))
+				binary.LittleEndian.PutUint32(packet[4:], uint32(i))
+				if err := buffer.Push(packet); err != nil {
+					t.Error(err)
+					return
+				}
+			}
+		}(producer)
+	}
+	// the default consumer and a named one pop at the same time, each of them commits only its own packets
+	shipper, err := buffer.Consumer("shipper")
+	assert(err, "==", nil)
+	consumers := []interface{ PopN(n int) [][]byte }{buffer, shipper}
+	received := make([]chan []byte, len(consumers))
+	poppers := sync.WaitGroup{}
+	for i, consumer := range consumers {
+		received[i] = make(chan []byte, producers*packetsPerProducer)
+		poppers.Add(1)
+		go func(consumer interface{ PopN(n int) [][]byte }, received chan []byte) {
+			defer poppers.Done()
+			for len(received) < producers*packetsPerProducer {
+				for _, packet := range consumer.PopN(7) {
+					received <- packet
+				}
+			}
+			close(received)
+		}(consumer, received[i])
+	}
+	pushers.Wait()
+	poppers.Wait()
+	for _, packets := range received {
+		nextOfProducer := make([]uint32, producers)
+		for packet := range packets {
+			producer := binary.LittleEndian.Uint32(packet)
+			// in order, the packets of each producer are pushed one after another
+			assert(binary.LittleEndian.Uint32(packet[4:]), "==", nextOfProducer[producer])
+			nextOfProducer[producer] += 1
+		}
+		for producer := 0; producer < producers; producer++ {
+			assert(nextOfProducer[producer], "==", uint32(packetsPerProducer))
+		}
+	}
+	assert(buffer.DroppedPackets(), "==", uint64(0))
+	assert(shipper.DroppedPackets(), "==", uint64(0))
+}
+
+func Test_copied_packets(t *testing.T) {
+	assert := NewAssert(t)
+	assert(ensureFileNotExist("/tmp/drbuffer_concurrent"), "==", nil)
+	buffer, err := Open("/tmp/drbuffer_concurrent", 1, WithCopiedPackets())
+	assert(err, "==", nil)
+	defer buffer.Close()
+	buffer.PushN([][]byte{
+		[]byte("A"),
+		[]byte("B"),
+	})
+	first := buffer.PopN(1)
+	second := buffer.PopN(1)
+	assert(string(first[0]), "==", "A")
+	assert(string(second[0]), "==", "B")
+	batch, _ := buffer.Pop(1)
+	assert(len(batch.Packets), "==", 0)
+	buffer.PushOne([]byte("C"))
+	batch, _ = buffer.Pop(1)
+	buffer.(*durableRingBuffer).data[buffer.(*durableRingBuffer).format.headerSize()*3+2] = 'X'
+	assert(string(batch.Packets[0]), "==", "C")
+}
@@ -0,0 +1,290 @@
+package drbuffer
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"iter"
+	"strings"
+	"time"
+)
+
+// named consumers are stored in the wide meta section after the shadow slots, one slot for each:
+// [48 name][8 lastReadTo][8 droppedPackets][8 poppedPackets]
+const CONSUMER_TABLE_OFFSET = SHADOW_META_OFFSET + 2*SHADOW_META_SLOT_SIZE
+const CONSUMER_SLOT_SIZE = 72
+const MAX_CONSUMER_NAME_SIZE = 48
+const MAX_CONSUMERS = (WIDE_META_SECTION_SIZE - CONSUMER_TABLE_OFFSET) / CONSUMER_SLOT_SIZE
+
+var ErrTooManyConsumers = errors.New("too many consumers")
+var ErrConsumerRemoved = errors.New("consumer is removed")
+
+// ErrInvalidConsumerName is returned for an empty name, a name longer than MAX_CONSUMER_NAME_SIZE bytes
+// or one containing a NUL byte, which would not read back the same from the consumer table
+var ErrInvalidConsumerName = errors.New("invalid consumer name")
+
+// Consumer reads the buffer with its own persisted read position
+type Consumer interface {
+	PopN(n int) [][]byte
+	PopNChecked(n int) ([][]byte, error)
+	PopOne() []byte
+	PopWait(ctx context.Context, n int) ([][]byte, error)
+	Packets(ctx context.Context) <-chan []byte
+	Peek(n int) ([][]byte, error)
+	All() iter.Seq[[]byte]
+	Iterator() *Iterator
+	Pop(n int) (*Batch, error)
+	Commit() error
+	DroppedPackets() uint64
+}
+
+func (buffer *ringBuffer) consumerSlot(i int) []byte {
+	offset := CONSUMER_TABLE_OFFSET + i*CONSUMER_SLOT_SIZE
+	return buffer.meta[offset : offset+CONSUMER_SLOT_SIZE]
+}
+
+func consumerLastReadTo(slot []byte, version uint32) metaField {
+	return newMetaField(slot, version, 0, MAX_CONSUMER_NAME_SIZE)
+}
+
+func consumerDroppedPackets(slot []byte, version uint32) metaField {
+	return newMetaField(slot, version, 0, MAX_CONSUMER_NAME_SIZE+8)
+}
+
+func consumerPoppedPackets(slot []byte, version uint32) metaField {
+	return newMetaField(slot, version, 0, MAX_CONSUMER_NAME_SIZE+16)
+}
+
+func (buffer *ringBuffer) loadConsumers() []*cursor {
+	if *buffer.version < FIRST_WIDE_VERSION {
+		return nil
+	}
+	consumers := []*cursor{}
+	for i := 0; i < MAX_CONSUMERS; i++ {
+		slot := buffer.consumerSlot(i)
+		if slot[0] == 0 {
+			continue
+		}
+		name := string(bytes.TrimRight(slot[:MAX_CONSUMER_NAME_SIZE], "\x00"))
+		consumers = append(consumers, buffer.newCursor(name, consumerLastReadTo(slot, *buffer.version),
+			consumerDroppedPackets(slot, *buffer.version), consumerPoppedPackets(slot, *buffer.version)))
+	}
+	return consumers
+}
+
+// consumer registers the name on first use, starting from what the default consumer has not committed
+func (buffer *ringBuffer) consumer(name string) (*cursor, error) {
+	if *buffer.version < FIRST_WIDE_VERSION {
+		return nil, fmt.Errorf("named consumer requires file version %d, got %d", FIRST_WIDE_VERSION, *buffer.version)
+	}
+	if name == "" || len(name) > MAX_CONSUMER_NAME_SIZE || strings.IndexByte(name, 0) >= 0 {
+		return nil, fmt.Errorf("%w: %q", ErrInvalidConsumerName, name)
+	}
+	for _, cursor := range buffer.cursors[1:] {
+		if cursor.name == name {
+			return cursor, nil
+		}
+	}
+	for i := 0; i < MAX_CONSUMERS; i++ {
+		slot := buffer.consumerSlot(i)
+		if slot[0] != 0 {
+			continue
+		}
+		lastReadTo := consumerLastReadTo(slot, *buffer.version)
+		lastReadTo.store(buffer.cursor.lastReadTo.load())
+		copy(slot, name)
+		cursor := buffer.newCursor(name, lastReadTo, consumerDroppedPackets(slot, *buffer.version), consumerPoppedPackets(slot, *buffer.version))
+		buffer.cursors = append(buffer.cursors, cursor)
+		return cursor, nil
+	}
+	return nil, ErrTooManyConsumers
+}
+
+// removeConsumer stops protecting the packets the consumer has not committed
+func (buffer *ringBuffer) removeConsumer(name string) error {
+	for i, cursor := range buffer.cursors {
+		if i == 0 || cursor.name != name {
+			continue
+		}
+		for j := 0; j < MAX_CONSUMERS; j++ {
+			slot := buffer.consumerSlot(j)
+			if string(bytes.TrimRight(slot[:MAX_CONSUMER_NAME_SIZE], "\x00")) == name {
+				copy(slot, make([]byte, CONSUMER_SLOT_SIZE))
+			}
+		}
+		cursor.removed = true
+		buffer.cursors = append(buffer.cursors[:i], buffer.cursors[i+1:]...)
+		return nil
+	}
+	return fmt.Errorf("consumer not found: %q", name)
+}
+
+type durableConsumer struct {
+	buffer *durableRingBuffer
+	cursor *cursor
+}
+
+func (consumer *durableConsumer) PopOne() []byte {
+	packets := consumer.PopN(1)
+	if len(packets) > 0 {
+		return packets[0]
+	} else {
+		return nil
+	}
+}
+
+func (consumer *durableConsumer) PopN(maxPacketsCount int) [][]byte {
+	packets, _ := consumer.PopNChecked(maxPacketsCount)
+	return packets
+}
+
+func (consumer *durableConsumer) PopNChecked(maxPacketsCount int) ([][]byte, error) {
+	consumer.buffer.lock.Lock()
+	defer consumer.buffer.lock.Unlock()
+	if err := consumer.checkUsable(); err != nil {
+		return nil, err
+	}
+	// the last batch is committed by this pop, the space it took can be reused
+	defer consumer.buffer.spaceFreed.Broadcast()
+	packets, err := consumer.cursor.PopNChecked(maxPacketsCount)
+	if consumer.buffer.copyPackets {
+		packets = copyPackets(packets)
+	}
+	return packets, err
+}
+
+// PopWait is PopNChecked blocking until at least one packet is popped, or the context is done.
+// it does not block when asked for no packets at all
+// the producer wakes it up in the same process, the producer in another process is polled
+func (consumer *durableConsumer) PopWait(ctx context.Context, maxPacketsCount int) ([][]byte, error) {
+	return consumer.popWait(ctx, maxPacketsCount, consumer.buffer.copyPackets)
+}
+
+// popWait copies the packets while holding the lock, if asked to
+func (consumer *durableConsumer) popWait(ctx context.Context, maxPacketsCount int, copyPopped bool) ([][]byte, error) {
+	consumer.buffer.lock.Lock()
+	defer consumer.buffer.lock.Unlock()
+	stopWaking := context.AfterFunc(ctx, func() {
+		consumer.buffer.lock.Lock()
+		defer consumer.buffer.lock.Unlock()
+		consumer.buffer.packetPushed.Broadcast()
+	})
+	defer stopWaking()
+	for {
+		if err := consumer.checkUsable(); err != nil {
+			return nil, err
+		}
+		packets, err := consumer.cursor.PopNChecked(maxPacketsCount)
+		consumer.buffer.spaceFreed.Broadcast()
+		if len(packets) > 0 || err != nil || maxPacketsCount <= 0 {
+			if copyPopped {
+				packets = copyPackets(packets)
+			}
+			return packets, err
+		}
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+		consumer.waitForPacket(ctx)
+	}
+}
+
+// waitForPacket expects the lock held
+func (consumer *durableConsumer) waitForPacket(ctx context.Context) {
+	if consumer.buffer.role != ConsumeOnly {
+		consumer.buffer.packetPushed.Wait()
+		return
+	}
+	// the producer in another process can not wake us up
+	consumer.buffer.lock.Unlock()
+	defer consumer.buffer.lock.Lock()
+	select {
+	case <-ctx.Done():
+	case <-time.After(consumer.buffer.pollInterval):
+	}
+}
+
+func (consumer *durableConsumer) Pop(maxPacketsCount int) (*Batch, error) {
+	consumer.buffer.lock.Lock()
+	defer consumer.buffer.lock.Unlock()
+	if err := consumer.checkUsable(); err != nil {
+		return nil, err
+	}
+	batch, err := consumer.cursor.Pop(maxPacketsCount)
+	batch.owner = consumer
+	if consumer.buffer.copyPackets {
+		batch.Packets = copyPackets(batch.Packets)
+	}
+	return batch, err
+}
+
+func (consumer *durableConsumer) Commit() error {
+	consumer.buffer.lock.Lock()
+	defer consumer.buffer.lock.Unlock()
+	if err := consumer.checkUsable(); err != nil {
+		return err
+	}
+	consumer.cursor.Commit()
+	consumer.buffer.spaceFreed.Broadcast()
+	return nil
+}
+
+func (consumer *durableConsumer) commitBatch(batch *Batch) error {
+	consumer.buffer.lock.Lock()
+	defer consumer.buffer.lock.Unlock()
+	if err := consumer.checkUsable(); err != nil {
+		return err
+	}
+	defer consumer.buffer.spaceFreed.Broadcast()
+	return consumer.cursor.commitBatch(batch)
+}
+
+func (consumer *durableConsumer) nackBatch(batch *Batch) error {
+	consumer.buffer.lock.Lock()
+	defer consumer.buffer.lock.Unlock()
+	if err := consumer.checkUsable(); err != nil {
+		return err
+	}
+	return consumer.cursor.nackBatch(batch)
+}
+
+func (consumer *durableConsumer) DroppedPackets() uint64 {
+	consumer.buffer.lock.Lock()
+	defer consumer.buffer.lock.Unlock()
+	if consumer.buffer.closed {
+		// the counter is in the unmapped meta section
+		return 0
+	}
+	return consumer.cursor.droppedPackets.load()
+}
+
+// checkUsable expects the lock held
+func (consumer *durableConsumer) checkUsable() error {
+	if consumer.buffer.closed {
+		return ErrClosed
+	}
+	if consumer.cursor.removed {
+		return ErrConsumerRemoved
+	}
+	if consumer.buffer.role == ProduceOnly || consumer.buffer.role == ReadOnly {
+		return ErrWrongRole
+	}
+	return nil
+}
+
+// copyPackets moves the packets out of the mmapped file in one allocation
+func copyPackets(packets [][]byte) [][]byte {
+	totalSize := 0
+	for _, packet := range packets {
+		totalSize += len(packet)
+	}
+	copied := make([][]byte, len(packets))
+	bytes := make([]byte, totalSize)
+	for i, packet := range packets {
+		copied[i] = bytes[:len(packet):len(packet)]
+		copy(copied[i], packet)
+		bytes = bytes[len(packet):]
+	}
+	return copied
+}
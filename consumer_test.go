@@ -0,0 +1,122 @@
+package drbuffer
+
+import (
+	"errors"
+	"strings"
+	"testing"
+)
+
+func Test_consumers_read_independently(t *testing.T) {
+	assert := NewAssert(t)
+	buffer := newBufferOfVersion(4, 100)
+	shipper, err := buffer.consumer("shipper")
+	assert(err, "==", nil)
+	archiver, err := buffer.consumer("archiver")
+	assert(err, "==", nil)
+	buffer.PushN([][]byte{
+		[]byte("A"),
+		[]byte("B"),
+	})
+	assert(len(shipper.PopN(1024)), "==", 2)
+	assert(len(shipper.PopN(1024)), "==", 0)
+	packets := archiver.PopN(1)
+	assert(len(packets), "==", 1)
+	assert(string(packets[0]), "==", "A")
+	assert(len(buffer.PopN(1024)), "==", 2)
+	again, err := buffer.consumer("archiver")
+	assert(err, "==", nil)
+	assert(again == archiver, "==", true)
+}
+
+func Test_consumer_offset_persisted_in_meta(t *testing.T) {
+	assert := NewAssert(t)
+	meta := make([]byte, WIDE_META_SECTION_SIZE)
+	meta[0] = 4
+	data := make([]byte, 100)
+	buffer := NewRingBuffer(meta, data)
+	shipper, _ := buffer.consumer("shipper")
+	buffer.PushN([][]byte{
+		[]byte("A"),
+		[]byte("B"),
+	})
+	shipper.PopN(1)
+	shipper.Commit()
+	reopened := NewRingBuffer(meta, data)
+	assert(len(reopened.cursors), "==", 2)
+	shipper, _ = reopened.consumer("shipper")
+	assert(shipper.lastReadTo.load(), "==", uint64(9))
+	packets := shipper.PopN(1024)
+	assert(len(packets), "==", 1)
+	assert(string(packets[0]), "==", "B")
+	packets = reopened.PopN(1024)
+	assert(len(packets), "==", 2)
+}
+
+func Test_overwrite_repels_every_consumer(t *testing.T) {
+	assert := NewAssert(t)
+	buffer := newBufferOfVersion(4, 30)
+	shipper, _ := buffer.consumer("shipper")
+	buffer.PushN([][]byte{
+		[]byte("A"),
+		[]byte("B"),
+		[]byte("C"),
+	})
+	buffer.PopN(1024)
+	buffer.Commit() // default consumer is done
+	buffer.PushOne([]byte("DD"))
+	assert(buffer.DroppedPackets(), "==", uint64(0))
+	assert(shipper.DroppedPackets(), "==", uint64(2))
+	packets := shipper.PopN(1024)
+	assert(len(packets), "==", 2)
+	assert(string(packets[0]), "==", "C")
+	assert(string(packets[1]), "==", "DD")
+	packets = buffer.PopN(1024)
+	assert(len(packets), "==", 1)
+	assert(string(packets[0]), "==", "DD")
+}
+
+func Test_reject_respects_every_consumer(t *testing.T) {
+	assert := NewAssert(t)
+	buffer := newBufferOfVersion(4, 30)
+	buffer.overflowPolicy = RejectNewest
+	shipper, _ := buffer.consumer("shipper")
+	buffer.PushN([][]byte{
+		[]byte("A"),
+		[]byte("B"),
+		[]byte("C"),
+	})
+	buffer.PopN(1024)
+	buffer.Commit()
+	assert(buffer.Push([]byte("DD")), "==", ErrFull)
+	shipper.PopN(1024)
+	shipper.Commit()
+	assert(buffer.Push([]byte("DD")), "==", nil)
+	assert(buffer.removeConsumer("shipper"), "==", nil)
+	assert(len(buffer.cursors), "==", 1)
+	assert(buffer.consumerSlot(0), "==", make([]byte, CONSUMER_SLOT_SIZE))
+}
+
+func Test_consumer_not_supported_before_version_4(t *testing.T) {
+	assert := NewAssert(t)
+	buffer := newBufferOfVersion(3, 30)
+	_, err := buffer.consumer("shipper")
+	assert(err, "!=", nil)
+}
+
+func Test_consumer_name(t *testing.T) {
+	assert := NewAssert(t)
+	buffer := newBufferOfVersion(4, 30)
+	for _, name := range []string{"", strings.Repeat("A", MAX_CONSUMER_NAME_SIZE+1), "ship\x00per", "\x00"} {
+		_, err := buffer.consumer(name)
+		assert(errors.Is(err, ErrInvalidConsumerName), "==", true)
+	}
+	_, err := buffer.consumer(strings.Repeat("A", MAX_CONSUMER_NAME_SIZE))
+	assert(err, "==", nil)
+	assert(buffer.removeConsumer(strings.Repeat("A", MAX_CONSUMER_NAME_SIZE)), "==", nil)
+	for i := 0; i < MAX_CONSUMERS; i++ {
+		_, err = buffer.consumer(string(rune('A' + i)))
+		assert(err, "==", nil)
+	}
+	_, err = buffer.consumer("one more")
+	assert(err, "==", ErrTooManyConsumers)
+}
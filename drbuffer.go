@@ -1,27 +1,67 @@
 package drbuffer
 
 import (
+	"context"
 	"errors"
 	"fmt"
 	"os"
-	"reflect"
+	"path/filepath"
+	"sync"
 	"syscall"
+	"time"
 	"unsafe"
 )
 
 type DurableRingBuffer interface {
 	PushN(packets [][]byte)
 	PushOne(packet []byte)
-	PopN(n int) [][]byte
-	PopOne() []byte
+	Push(packet []byte) error
+	// PushWithSequence is Push returning the sequence number of the packet, it is always 0 before version 5
+	PushWithSequence(packet []byte) (uint64, error)
+	PushBatch(packets [][]byte) (int, error)
+	Consumer // the default consumer
 	Flush() error
 	Close() error
+	RecoveryReport() RecoveryReport
+	// Consumer returns the named consumer, registers it if not found
+	Consumer(name string) (Consumer, error)
+	RemoveConsumer(name string) error
+	Sink(ctx context.Context) (chan<- []byte, <-chan error)
+	Stats() Stats
+	DrainSpill(handle func(packet []byte, sequence uint64) error) error
 }
 
+var ErrClosed = errors.New("buffer is closed")
+var ErrWrongRole = errors.New("operation not allowed for the role the buffer is opened with")
+
+// CROSS_PROCESS_POLL_INTERVAL is how often a blocked producer or consumer checks the other process by default
+const CROSS_PROCESS_POLL_INTERVAL = time.Millisecond
+
+// durableRingBuffer serializes access to the ring, so it can be pushed and popped from multiple goroutines.
+// BlockUntilSpace waits for a reader in another goroutine. the lock is always taken rather than selected at Open:
+// uncontended it costs little next to copying the packet, and PopWait, BlockUntilSpace and the syncer wait on it
 type durableRingBuffer struct {
-	ringBuffer
-	file        *os.File
-	mmappedFile []byte
+	*ringBuffer
+	*durableConsumer // the default consumer
+	file             *os.File
+	mmappedFile      []byte
+	recoveryReport   RecoveryReport
+	lock             sync.Mutex
+	spaceFreed       *sync.Cond
+	packetPushed     *sync.Cond
+	done             chan struct{} // closed by Close
+	flushes          uint64
+	flushDuration    time.Duration
+	closed           bool
+	copyPackets      bool
+	role             Role
+	pollInterval     time.Duration // how often a blocked producer or consumer checks the other process
+	spillFile        *os.File      // nil without WithSpillFile
+	spillReadFrom    metaField     // how much of the spill file is drained
+	syncPolicy       SyncPolicy
+	unsyncedBytes    uint64        // pushed since last flush
+	syncErr          error         // failed background flush, returned by next Flush or Close
+	syncerStopped    chan struct{} // closed once the background syncer returns
 }
 
 type annotatedError struct {
@@ -33,84 +73,452 @@ func (err annotatedError) Error() string {
 	return fmt.Sprintf("%s: %s", err.annotation, err.originalError.Error())
 }
 
-func Open(filePath string, nkiloBytes int) (DurableRingBuffer, error) {
-	isNewFile, fileObj, fileSize, err := openOrCreateFile(filePath, nkiloBytes)
+// Open creates the file with nkiloBytes for packets if it does not exist yet, otherwise nkiloBytes is ignored unless WithAutoGrow
+func Open(filePath string, nkiloBytes int, optionList ...Option) (DurableRingBuffer, error) {
+	if err := checkKiloBytes(nkiloBytes); err != nil {
+		return nil, err
+	}
+	opts := newOptions(optionList)
+	if opts.role == ProduceOnly && opts.overflowPolicy == OverwriteOldest {
+		return nil, errors.New("producer can not overwrite the consumer in another process, use RejectNewest or BlockUntilSpace")
+	}
+	if opts.syncPolicy.mode == syncEveryInterval && opts.syncPolicy.interval <= 0 {
+		return nil, fmt.Errorf("sync interval must be positive: %s", opts.syncPolicy.interval)
+	}
+	if opts.pollInterval <= 0 {
+		return nil, fmt.Errorf("poll interval must be positive: %s", opts.pollInterval)
+	}
+	if (opts.spillPath != "" || opts.evictionHandler != nil) && opts.role != ProduceAndConsume {
+		return nil, errors.New("evicted packets can only be handed over with the producer and the consumer in one process")
+	}
+	if opts.autoGrow && opts.role != ReadOnly {
+		if err := growIfSmaller(filePath, nkiloBytes); err != nil {
+			return nil, annotatedError{err, "failed to grow file"}
+		}
+	}
+	newFileSize := int64(metaSectionSize(CURRENT_VERSION)) + int64(nkiloBytes)*1024
+	isNewFile, fileObj, fileSize, err := false, (*os.File)(nil), int64(0), error(nil)
+	protection := syscall.PROT_READ | syscall.PROT_WRITE
+	if opts.role == ReadOnly {
+		fileObj, fileSize, err = openReadOnlyFile(filePath)
+		if err != nil {
+			err = annotatedError{err, "failed to open or create file"}
+		}
+		protection = syscall.PROT_READ
+	} else {
+		isNewFile, fileObj, fileSize, err = openLocked(filePath, newFileSize, opts.role, opts.lockTimeout)
+	}
 	if err != nil {
-		return nil, annotatedError{err, "failed to open or create file"}
+		return nil, err
 	}
-	mmappedFile, err := syscall.Mmap(int(fileObj.Fd()), 0, fileSize, syscall.PROT_READ|syscall.PROT_WRITE, syscall.MAP_SHARED)
+	if fileSize != int64(int(fileSize)) {
+		fileObj.Close()
+		return nil, fmt.Errorf("file of %d bytes can not be mmapped on this platform", fileSize)
+	}
+	if fileSize < META_SECTION_SIZE {
+		fileObj.Close()
+		return nil, fmt.Errorf("file of %d bytes is too small", fileSize)
+	}
+	mmappedFile, err := syscall.Mmap(int(fileObj.Fd()), 0, int(fileSize), protection, syscall.MAP_SHARED)
 	if err != nil {
+		fileObj.Close()
 		return nil, annotatedError{err, "failed to mmap"}
 	}
 	syscall.Madvise(mmappedFile, syscall.MADV_SEQUENTIAL)
+	version := readVersion(mmappedFile)
+	if err = checkVersion(version); err == nil && len(mmappedFile) < metaSectionSize(version) {
+		err = fmt.Errorf("file of %d bytes is too small for version %d", fileSize, version)
+	}
+	if err != nil {
+		syscall.Munmap(mmappedFile)
+		fileObj.Close()
+		return nil, err
+	}
+	metaSize := metaSectionSize(version)
 	buffer := &durableRingBuffer{
-		ringBuffer:  *NewRingBuffer(mmappedFile[:META_SECTION_SIZE], mmappedFile[META_SECTION_SIZE:]),
+		ringBuffer:  NewRingBuffer(mmappedFile[:metaSize], mmappedFile[metaSize:]),
 		file:        fileObj,
 		mmappedFile: mmappedFile,
 	}
-	if isNewFile {
-		*buffer.version = 1
-	} else {
-		if *buffer.version != 1 {
-			return nil, errors.New(fmt.Sprintf("unsupported file version: %s", *buffer.version))
+	buffer.overflowPolicy = opts.overflowPolicy
+	buffer.copyPackets = opts.copyPackets
+	buffer.role = opts.role
+	buffer.pollInterval = opts.pollInterval
+	buffer.sharedAcrossProcesses = opts.role != ProduceAndConsume
+	buffer.spaceFreed = sync.NewCond(&buffer.lock)
+	buffer.packetPushed = sync.NewCond(&buffer.lock)
+	buffer.done = make(chan struct{})
+	buffer.durableConsumer = &durableConsumer{buffer, &buffer.ringBuffer.cursor}
+	// the previous process may have left pages not synced anywhere
+	buffer.markAllDirty()
+	buffer.spillReadFrom = newCounterField(buffer.meta, version, 72)
+	if opts.spillPath != "" && version < FIRST_WIDE_VERSION {
+		syscall.Munmap(mmappedFile)
+		fileObj.Close()
+		return nil, fmt.Errorf("spill file not supported before version %d, the drained position can not be persisted", FIRST_WIDE_VERSION)
+	}
+	if opts.spillPath != "" || opts.evictionHandler != nil {
+		if err = buffer.openSpill(opts); err != nil {
+			syscall.Munmap(mmappedFile)
+			fileObj.Close()
+			return nil, err
+		}
+	}
+	if !isNewFile && (opts.role == ProduceAndConsume || opts.role == ProduceOnly) {
+		// the consumer must not move the write pointers of a running producer
+		buffer.recoveryReport = buffer.recover()
+	} else if !opts.uncheckedMeta {
+		// not recovered, reading past the data section would panic
+		if err = buffer.checkPointers(); err != nil {
+			syscall.Munmap(mmappedFile)
+			fileObj.Close()
+			return nil, err
+		}
+	}
+	if opts.role == ProduceAndConsume || opts.role == ProduceOnly {
+		buffer.syncPolicy = opts.syncPolicy
+		if buffer.syncPolicy.mode == syncEveryInterval {
+			buffer.startSyncer()
 		}
 	}
 	return buffer, nil
 }
 
+// checkKiloBytes fails for a negative size, it would wrap around to a file filling the disk
+func checkKiloBytes(nkiloBytes int) error {
+	if nkiloBytes < 0 {
+		return fmt.Errorf("size must not be negative: %d kilobytes", nkiloBytes)
+	}
+	return nil
+}
+
+// RecoveryReport tells what was repaired when the existing file was opened
+func (buffer *durableRingBuffer) RecoveryReport() RecoveryReport {
+	return buffer.recoveryReport
+}
+
+func (buffer *durableRingBuffer) PushOne(p []byte) {
+	if err := buffer.Push(p); err != nil {
+		panic(err.Error())
+	}
+}
+
+func (buffer *durableRingBuffer) PushN(pList [][]byte) {
+	if _, err := buffer.PushBatch(pList); err != nil {
+		panic(err.Error())
+	}
+}
+
+func (buffer *durableRingBuffer) Push(p []byte) error {
+	_, err := buffer.pushContext(context.Background(), p)
+	return err
+}
+
+func (buffer *durableRingBuffer) PushWithSequence(p []byte) (uint64, error) {
+	return buffer.pushContext(context.Background(), p)
+}
+
+// pushContext is Push giving up waiting for space once the context is done
+func (buffer *durableRingBuffer) pushContext(ctx context.Context, p []byte) (uint64, error) {
+	buffer.lock.Lock()
+	defer buffer.lock.Unlock()
+	sequence, err := buffer.push(ctx, p)
+	if err == nil {
+		err = buffer.syncAfterBatch()
+	}
+	return sequence, err
+}
+
+func (buffer *durableRingBuffer) PushBatch(pList [][]byte) (int, error) {
+	buffer.lock.Lock()
+	defer buffer.lock.Unlock()
+	for i, p := range pList {
+		if _, err := buffer.push(context.Background(), p); pushedAnyway(err) {
+			return i + 1, err
+		} else if err != nil {
+			return i, err
+		}
+	}
+	if err := buffer.syncAfterBatch(); err != nil {
+		return len(pList), err
+	}
+	return len(pList), nil
+}
+
+func (buffer *durableRingBuffer) push(ctx context.Context, p []byte) (uint64, error) {
+	if buffer.closed {
+		return 0, ErrClosed
+	}
+	if buffer.role == ConsumeOnly || buffer.role == ReadOnly {
+		return 0, ErrWrongRole
+	}
+	sequence, err := buffer.ringBuffer.PushWithSequence(p)
+	if err == ErrFull && buffer.overflowPolicy == BlockUntilSpace {
+		stopWaking := context.AfterFunc(ctx, func() {
+			buffer.lock.Lock()
+			defer buffer.lock.Unlock()
+			buffer.spaceFreed.Broadcast()
+		})
+		defer stopWaking()
+	}
+	for err == ErrFull && buffer.overflowPolicy == BlockUntilSpace {
+		if err := ctx.Err(); err != nil {
+			return 0, err
+		}
+		buffer.waitForSpace(ctx)
+		if buffer.closed {
+			return 0, ErrClosed
+		}
+		sequence, err = buffer.ringBuffer.PushWithSequence(p)
+	}
+	if err == nil || pushedAnyway(err) {
+		buffer.packetPushed.Broadcast()
+	}
+	if err == nil {
+		err = buffer.syncAfterPacket(buffer.format.headerSize() + uint64(len(p)))
+	}
+	return sequence, err
+}
+
+// waitForSpace expects the lock held
+func (buffer *durableRingBuffer) waitForSpace(ctx context.Context) {
+	if buffer.role == ProduceOnly {
+		// the consumer in another process can not wake us up
+		buffer.lock.Unlock()
+		defer buffer.lock.Lock()
+		select {
+		case <-ctx.Done():
+		case <-time.After(buffer.pollInterval):
+		}
+	} else {
+		buffer.spaceFreed.Wait()
+	}
+}
+
+// Consumer is not supported across processes, the producer would not see the consumer registered later
+func (buffer *durableRingBuffer) Consumer(name string) (Consumer, error) {
+	buffer.lock.Lock()
+	defer buffer.lock.Unlock()
+	if buffer.closed {
+		return nil, ErrClosed
+	}
+	if buffer.role != ProduceAndConsume {
+		return nil, ErrWrongRole
+	}
+	cursor, err := buffer.consumer(name)
+	if err != nil {
+		return nil, err
+	}
+	return &durableConsumer{buffer, cursor}, nil
+}
+
+func (buffer *durableRingBuffer) RemoveConsumer(name string) error {
+	buffer.lock.Lock()
+	defer buffer.lock.Unlock()
+	if buffer.closed {
+		return ErrClosed
+	}
+	if buffer.role == ReadOnly {
+		return ErrWrongRole
+	}
+	defer buffer.spaceFreed.Broadcast()
+	return buffer.removeConsumer(name)
+}
+
+// Close flushes what the sync policy has not flushed yet, unless SyncManual
 func (buffer *durableRingBuffer) Close() error {
+	err := buffer.close()
+	if buffer.syncerStopped != nil {
+		<-buffer.syncerStopped
+	}
+	return err
+}
+
+func (buffer *durableRingBuffer) close() error {
+	buffer.lock.Lock()
+	defer buffer.lock.Unlock()
+	if buffer.closed {
+		return ErrClosed
+	}
+	syncErr := buffer.syncErr
+	if buffer.syncPolicy.mode != syncManual && buffer.unsyncedBytes > 0 {
+		if err := buffer.flush(); err != nil && syncErr == nil {
+			syncErr = err
+		}
+	}
+	buffer.closed = true
+	close(buffer.done)
+	buffer.spaceFreed.Broadcast()
+	buffer.packetPushed.Broadcast()
+	if buffer.spillFile != nil {
+		buffer.spillFile.Close()
+	}
 	err := syscall.Munmap(buffer.mmappedFile)
 	if err != nil {
 		return annotatedError{err, "failed to munmap"}
 	}
-	return buffer.file.Close()
+	if err = buffer.file.Close(); err != nil {
+		return err
+	}
+	return syncErr
 }
 
 func (buffer *durableRingBuffer) Flush() error {
-	header := (*reflect.SliceHeader)(unsafe.Pointer(&buffer.mmappedFile))
-	_, _, errno := syscall.Syscall(syscall.SYS_MSYNC, header.Data, uintptr(header.Len), syscall.MS_SYNC)
-	if errno != 0 {
-		return syscall.Errno(errno)
-	} else {
-		return nil
+	buffer.lock.Lock()
+	defer buffer.lock.Unlock()
+	if buffer.closed {
+		return ErrClosed
+	}
+	syncErr := buffer.syncErr
+	buffer.syncErr = nil
+	if err := buffer.flush(); err != nil {
+		return err
 	}
+	return syncErr
 }
 
-func openOrCreateFile(filePath string, nkiloBytes int) (bool, *os.File, int, error) {
+// flush expects the lock held
+func (buffer *durableRingBuffer) flush() error {
+	startedAt := time.Now()
+	if buffer.spillFile != nil {
+		if err := buffer.spillFile.Sync(); err != nil {
+			return annotatedError{err, "failed to sync spill file"}
+		}
+	}
+	err := buffer.syncDirty()
+	buffer.flushes += 1
+	buffer.flushDuration += time.Since(startedAt)
+	if err != nil {
+		return err
+	}
+	buffer.unsyncedBytes = 0
+	return nil
+}
+
+func openReadOnlyFile(filePath string) (*os.File, int64, error) {
+	fileObj, err := os.Open(filePath)
+	if err != nil {
+		return nil, 0, err
+	}
+	fi, err := fileObj.Stat()
+	if err != nil {
+		fileObj.Close()
+		return nil, 0, annotatedError{err, "failed to get file size"}
+	}
+	return fileObj, fi.Size(), nil
+}
+
+// openLocked opens the file and takes the lock of the role, producer and consumer roles are locked separately,
+// so a producer process and a consumer process can share the file. Resize renames the new file over the path while
+// holding the lock of the old one, whoever was waiting for that lock opens the path again
+func openLocked(filePath string, newFileSize int64, role Role, lockTimeout time.Duration) (bool, *os.File, int64, error) {
+	for {
+		isNewFile, fileObj, fileSize, err := openOrCreateFile(filePath, newFileSize)
+		if err != nil {
+			return isNewFile, nil, 0, annotatedError{err, "failed to open or create file"}
+		}
+		if err = lockFile(fileObj, role, lockTimeout); err != nil {
+			fileObj.Close()
+			return isNewFile, nil, 0, err
+		}
+		replaced, err := fileReplaced(fileObj, filePath)
+		if err != nil {
+			fileObj.Close()
+			return isNewFile, nil, 0, err
+		}
+		if !replaced {
+			return isNewFile, fileObj, fileSize, nil
+		}
+		fileObj.Close()
+	}
+}
+
+// fileReplaced tells if filePath no longer leads to the opened file
+func fileReplaced(fileObj *os.File, filePath string) (bool, error) {
+	opened, err := fileObj.Stat()
+	if err != nil {
+		return false, annotatedError{err, "failed to stat opened file"}
+	}
+	current, err := os.Stat(filePath)
+	if os.IsNotExist(err) {
+		return true, nil
+	} else if err != nil {
+		return false, annotatedError{err, "failed to stat file"}
+	}
+	return !os.SameFile(opened, current), nil
+}
+
+// openOrCreateFile tells if the file is created by this call, a producer and a consumer may both find it missing:
+// the file is complete before it appears under filePath, and only one of them links it there
+func openOrCreateFile(filePath string, fileSize int64) (bool, *os.File, int64, error) {
 	isNewFile := false
 	fileObj, err := os.OpenFile(filePath, os.O_RDWR, 0644)
-	if err != nil {
-		if os.IsNotExist(err) {
-			isNewFile = true
-			fileObj, err = os.OpenFile(filePath, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0644)
-			if err != nil {
-				return isNewFile, nil, 0, annotatedError{err, "failed to create new file"}
-			}
-			emptyBytes := make([]byte, 1024)
-			for i := 0; i < nkiloBytes; i++ {
-				n, err := fileObj.Write(emptyBytes)
-				if n != 1024 {
-					panic("initialize disk file unsuccessful")
-				}
-				if err != nil {
-					return isNewFile, nil, 0, annotatedError{err, "failed to write empty bytes"}
-				}
-			}
-			err = fileObj.Close()
-			if err != nil {
-				return isNewFile, nil, 0, annotatedError{err, "failed to close new file"}
-			}
-			fileObj, err = os.OpenFile(filePath, os.O_RDWR, 0644)
-			if err != nil {
-				return isNewFile, nil, 0, annotatedError{err, "failed to open newly created file"}
-			}
-		} else {
-			return isNewFile, nil, 0, annotatedError{err, "failed to open existing file"}
+	if os.IsNotExist(err) {
+		isNewFile, err = createFile(filePath, fileSize)
+		if err != nil {
+			return isNewFile, nil, 0, err
 		}
+		fileObj, err = os.OpenFile(filePath, os.O_RDWR, 0644)
+		if err != nil {
+			return isNewFile, nil, 0, annotatedError{err, "failed to open newly created file"}
+		}
+	} else if err != nil {
+		return isNewFile, nil, 0, annotatedError{err, "failed to open existing file"}
 	}
 	fi, err := fileObj.Stat()
 	if err != nil {
+		fileObj.Close()
 		return isNewFile, nil, 0, annotatedError{err, "failed to get file size"}
 	}
-	return isNewFile, fileObj, int(fi.Size()), nil
+	return isNewFile, fileObj, fi.Size(), nil
+}
+
+// createFile writes a new file of the current version aside, then links it to filePath unless another process did first
+func createFile(filePath string, fileSize int64) (bool, error) {
+	fileObj, err := os.CreateTemp(filepath.Dir(filePath), filepath.Base(filePath)+".creating*")
+	if err != nil {
+		return false, annotatedError{err, "failed to create new file"}
+	}
+	defer os.Remove(fileObj.Name())
+	// CreateTemp makes it private, the consumer and the command line tool may run as other users
+	if err = fileObj.Chmod(0644); err != nil {
+		fileObj.Close()
+		return false, annotatedError{err, "failed to change mode of new file"}
+	}
+	if err = writeZeros(fileObj, uint64(fileSize)); err != nil {
+		fileObj.Close()
+		return false, err
+	}
+	// the other process opening it right after the link finds the version
+	version := make([]byte, 4)
+	*(*uint32)(unsafe.Pointer(&version[0])) = CURRENT_VERSION
+	if _, err = fileObj.WriteAt(version, 0); err != nil {
+		fileObj.Close()
+		return false, annotatedError{err, "failed to write version"}
+	}
+	if err = fileObj.Close(); err != nil {
+		return false, annotatedError{err, "failed to close new file"}
+	}
+	if err = os.Link(fileObj.Name(), filePath); os.IsExist(err) {
+		// created by another process meanwhile
+		return false, nil
+	} else if err != nil {
+		return false, annotatedError{err, "failed to link new file"}
+	}
+	return true, nil
+}
+
+// writeZeros writes the zeros instead of truncate, so disk space is allocated before mmapped
+func writeZeros(fileObj *os.File, size uint64) error {
+	emptyBytes := make([]byte, 1024*1024)
+	for written := uint64(0); written < size; written += uint64(len(emptyBytes)) {
+		chunk := emptyBytes
+		if size-written < uint64(len(chunk)) {
+			chunk = chunk[:size-written]
+		}
+		if _, err := fileObj.Write(chunk); err != nil {
+			return annotatedError{err, "failed to write empty bytes"}
+		}
+	}
+	return nil
 }
@@ -1,8 +1,10 @@
 package drbuffer
 
 import (
+	"encoding/binary"
 	"os"
 	"testing"
+	"time"
 )
 
 func Test_new_file(t *testing.T) {
@@ -23,6 +25,212 @@ func Test_open_existing_file(t *testing.T) {
 	assert(buffer.PopOne(), "==", nil)
 }
 
+func Test_new_file_is_checksummed(t *testing.T) {
+	assert := NewAssert(t)
+	buffer := openNew(assert)
+	defer buffer.Close()
+	assert(*buffer.(*durableRingBuffer).version, "==", uint32(CURRENT_VERSION))
+	assert(buffer.(*durableRingBuffer).format.checksummed, "==", true)
+}
+
+func Test_open_version_1_file(t *testing.T) {
+	assert := NewAssert(t)
+	assert(ensureFileNotExist("/tmp/drbuffer"), "==", nil)
+	content := make([]byte, 1024)
+	copy(content, []byte{1, 0, 0, 0, 5, 0, 0, 0})
+	copy(content[META_SECTION_SIZE:], []byte{3, 0, 'a', 'b', 'c'})
+	assert(os.WriteFile("/tmp/drbuffer", content, 0644), "==", nil)
+	buffer, err := Open("/tmp/drbuffer", 1)
+	assert(err, "==", nil)
+	defer buffer.Close()
+	assert(string(buffer.PopOne()), "==", "abc")
+	assert(buffer.PopOne(), "==", nil)
+}
+
+func Test_open_unsupported_version(t *testing.T) {
+	assert := NewAssert(t)
+	assert(ensureFileNotExist("/tmp/drbuffer"), "==", nil)
+	content := make([]byte, 1024)
+	content[0] = 99
+	assert(os.WriteFile("/tmp/drbuffer", content, 0644), "==", nil)
+	_, err := Open("/tmp/drbuffer", 1)
+	assert(err, "!=", nil)
+}
+
+func Test_open_should_recover_unwritten_packet(t *testing.T) {
+	assert := NewAssert(t)
+	buffer := openNew(assert)
+	buffer.PushOne([]byte("Hello"))
+	buffer.PushOne([]byte("World"))
+	recordSize := buffer.(*durableRingBuffer).format.headerSize() + 5
+	buffer.(*durableRingBuffer).data[recordSize] = 0 // "World" lost with the data page
+	assert(buffer.Close(), "==", nil)
+	buffer, err := Open("/tmp/drbuffer", 1)
+	assert(err, "==", nil)
+	defer buffer.Close()
+	assert(buffer.RecoveryReport().Repaired(), "==", true)
+	assert(buffer.RecoveryReport().TruncatedBytes, "==", recordSize)
+	assert(string(buffer.PopOne()), "==", "Hello")
+	assert(buffer.PopOne(), "==", nil)
+}
+
+func Test_version_2_file_keeps_its_format(t *testing.T) {
+	assert := NewAssert(t)
+	assert(ensureFileNotExist("/tmp/drbuffer"), "==", nil)
+	content := make([]byte, 1024)
+	content[0] = 2
+	assert(os.WriteFile("/tmp/drbuffer", content, 0644), "==", nil)
+	buffer, err := Open("/tmp/drbuffer", 1)
+	assert(err, "==", nil)
+	defer buffer.Close()
+	assert(buffer.(*durableRingBuffer).format, "==", recordFormats[2])
+	assert(len(buffer.(*durableRingBuffer).data), "==", 1024-META_SECTION_SIZE)
+	buffer.PushOne([]byte("Hello"))
+	assert(buffer.(*durableRingBuffer).data[:2], "==", []byte{5, 0})
+	assert(string(buffer.PopOne()), "==", "Hello")
+}
+
+func Test_new_file_size(t *testing.T) {
+	assert := NewAssert(t)
+	buffer := openNew(assert)
+	defer buffer.Close()
+	assert(len(buffer.(*durableRingBuffer).mmappedFile), "==", WIDE_META_SECTION_SIZE+1024)
+	assert(len(buffer.(*durableRingBuffer).data), "==", 1024)
+}
+
+func Test_offsets_beyond_4GiB(t *testing.T) {
+	if testing.Short() {
+		t.Skip("maps a 5GiB sparse file")
+	}
+	assert := NewAssert(t)
+	assert(ensureFileNotExist("/tmp/drbuffer_large"), "==", nil)
+	defer os.Remove("/tmp/drbuffer_large")
+	dataSize := uint64(5 << 30)
+	pos := dataSize - 20 // beyond what uint32 can address
+	meta := make([]byte, WIDE_META_SECTION_SIZE)
+	binary.LittleEndian.PutUint32(meta[0:], 4)
+	binary.LittleEndian.PutUint64(meta[8:], pos)  // nextWriteFrom
+	binary.LittleEndian.PutUint64(meta[16:], pos) // lastReadTo
+	assert(os.WriteFile("/tmp/drbuffer_large", meta, 0644), "==", nil)
+	assert(os.Truncate("/tmp/drbuffer_large", int64(WIDE_META_SECTION_SIZE+dataSize)), "==", nil)
+	buffer, err := Open("/tmp/drbuffer_large", 1)
+	assert(err, "==", nil)
+	defer buffer.Close()
+	assert(buffer.RecoveryReport().Repaired(), "==", false)
+	buffer.PushOne([]byte("Hello"))
+	buffer.PushOne([]byte("World")) // wraps around
+	ring := buffer.(*durableRingBuffer).ringBuffer
+	assert(ring.wrapAt.load(), "==", pos+13)
+	assert(ring.nextWriteFrom.load(), "==", uint64(13))
+	packets := buffer.PopN(1024)
+	assert(len(packets), "==", 2)
+	assert(string(packets[0]), "==", "Hello")
+	assert(string(packets[1]), "==", "World")
+}
+
+func Test_block_until_space(t *testing.T) {
+	assert := NewAssert(t)
+	assert(ensureFileNotExist("/tmp/drbuffer"), "==", nil)
+	buffer, err := Open("/tmp/drbuffer", 1, WithOverflowPolicy(BlockUntilSpace))
+	assert(err, "==", nil)
+	defer buffer.Close()
+	assert(buffer.Push(make([]byte, 600)), "==", nil)
+	pushed := make(chan error)
+	go func() {
+		pushed <- buffer.Push(make([]byte, 300))
+		pushed <- buffer.Push(make([]byte, 300)) // wraps around to the 600 bytes packet
+	}()
+	assert(<-pushed, "==", nil)
+	assert(len(buffer.PopN(1)), "==", 1)
+	select {
+	case <-pushed:
+		t.Fatal("push should wait until the popped packet is committed")
+	case <-time.After(10 * time.Millisecond):
+	}
+	assert(len(buffer.PopN(1)), "==", 1)
+	assert(<-pushed, "==", nil)
+	assert(buffer.DroppedPackets(), "==", uint64(0))
+}
+
+func Test_close_should_unblock_push(t *testing.T) {
+	assert := NewAssert(t)
+	assert(ensureFileNotExist("/tmp/drbuffer"), "==", nil)
+	buffer, err := Open("/tmp/drbuffer", 1, WithOverflowPolicy(BlockUntilSpace))
+	assert(err, "==", nil)
+	// two records fill up the buffer
+	packet := make([]byte, 490)
+	buffer.PushN([][]byte{packet, packet})
+	pushed := make(chan error)
+	go func() {
+		pushed <- buffer.Push(packet)
+	}()
+	time.Sleep(10 * time.Millisecond)
+	assert(buffer.Close(), "==", nil)
+	assert(<-pushed, "==", ErrClosed)
+}
+
+func Test_uncommitted_batch_redelivered_after_reopen(t *testing.T) {
+	assert := NewAssert(t)
+	buffer := openNew(assert)
+	buffer.PushN([][]byte{
+		[]byte("Hello"),
+		[]byte("World"),
+	})
+	batch, err := buffer.Pop(1)
+	assert(err, "==", nil)
+	assert(batch.Commit(), "==", nil)
+	batch, err = buffer.Pop(1)
+	assert(string(batch.Packets[0]), "==", "World")
+	assert(buffer.Close(), "==", nil)
+	buffer, err = Open("/tmp/drbuffer", 1)
+	assert(err, "==", nil)
+	defer buffer.Close()
+	batch, err = buffer.Pop(1024)
+	assert(len(batch.Packets), "==", 1)
+	assert(string(batch.Packets[0]), "==", "World")
+}
+
+func Test_commit_should_unblock_push(t *testing.T) {
+	assert := NewAssert(t)
+	assert(ensureFileNotExist("/tmp/drbuffer"), "==", nil)
+	buffer, err := Open("/tmp/drbuffer", 1, WithOverflowPolicy(BlockUntilSpace))
+	assert(err, "==", nil)
+	defer buffer.Close()
+	buffer.PushN([][]byte{make([]byte, 600), make([]byte, 300)})
+	batch, _ := buffer.Pop(1)
+	pushed := make(chan error)
+	go func() {
+		pushed <- buffer.Push(make([]byte, 300))
+	}()
+	time.Sleep(10 * time.Millisecond)
+	assert(batch.Commit(), "==", nil)
+	assert(<-pushed, "==", nil)
+}
+
+func Test_named_consumer_survives_reopen(t *testing.T) {
+	assert := NewAssert(t)
+	buffer := openNew(assert)
+	shipper, err := buffer.Consumer("shipper")
+	assert(err, "==", nil)
+	buffer.PushN([][]byte{
+		[]byte("Hello"),
+		[]byte("World"),
+	})
+	assert(string(shipper.PopOne()), "==", "Hello")
+	assert(shipper.Commit(), "==", nil)
+	assert(buffer.Close(), "==", nil)
+	assert(shipper.Commit(), "==", ErrClosed)
+	buffer, err = Open("/tmp/drbuffer", 1)
+	assert(err, "==", nil)
+	defer buffer.Close()
+	shipper, err = buffer.Consumer("shipper")
+	assert(err, "==", nil)
+	assert(string(shipper.PopOne()), "==", "World")
+	assert(string(buffer.PopOne()), "==", "Hello")
+	assert(buffer.RemoveConsumer("shipper"), "==", nil)
+	assert(shipper.Commit(), "==", ErrConsumerRemoved)
+}
+
 func Test_perf(t *testing.T) {
 	t.Skip("slow")
 	assert := NewAssert(t)
@@ -35,6 +243,26 @@ func Test_perf(t *testing.T) {
 	}
 }
 
+func Test_sequence_numbers_survive_reopen(t *testing.T) {
+	assert := NewAssert(t)
+	buffer := openNew(assert)
+	buffer.PushN([][]byte{
+		[]byte("A"),
+		[]byte("B"),
+	})
+	assert(len(buffer.PopN(10)), "==", 2)
+	assert(buffer.Commit(), "==", nil)
+	assert(buffer.Close(), "==", nil)
+	buffer, err := Open("/tmp/drbuffer", 1)
+	assert(err, "==", nil)
+	defer buffer.Close()
+	sequence, err := buffer.PushWithSequence([]byte("C"))
+	assert(err, "==", nil)
+	assert(sequence, "==", uint64(3))
+	batch, _ := buffer.Pop(10)
+	assert(batch.Sequences, "==", []uint64{3})
+}
+
 func openNew(assert Assert) DurableRingBuffer {
 	assert(ensureFileNotExist("/tmp/drbuffer"), "==", nil)
 	buffer, err := Open("/tmp/drbuffer", 1)
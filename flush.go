@@ -0,0 +1,55 @@
+package drbuffer
+
+import (
+	"os"
+	"syscall"
+	"unsafe"
+)
+
+// markDirty records the range write changed since last flush. the writer moves forward,
+// so the ranges of one lap stay contiguous, one at the end of the previous lap and one from 0.
+// once the writer wraps again everything is dirty
+func (buffer *ringBuffer) markDirty(writeFrom, writeTo uint64) {
+	if n := len(buffer.dirty); n > 0 && buffer.dirty[n-1].to == writeFrom {
+		buffer.dirty[n-1].to = writeTo
+		return
+	}
+	buffer.dirty = append(buffer.dirty, recordSpan{writeFrom, writeTo})
+	if len(buffer.dirty) > 2 {
+		buffer.markAllDirty()
+	}
+}
+
+func (buffer *ringBuffer) markAllDirty() {
+	buffer.dirty = append(buffer.dirty[:0], recordSpan{0, uint64(len(buffer.data))})
+}
+
+// syncDirty syncs the data written since last flush, then the meta section pointing to it.
+// the kernel may write back the meta page before the data any time, only the shadow copy is written after the data is synced
+func (buffer *durableRingBuffer) syncDirty() error {
+	metaSize := uint64(len(buffer.meta))
+	for _, span := range buffer.dirty {
+		if err := buffer.msync(metaSize+span.from, metaSize+span.to); err != nil {
+			return err
+		}
+	}
+	buffer.dirty = buffer.dirty[:0]
+	if buffer.role == ProduceAndConsume || buffer.role == ProduceOnly {
+		buffer.writeShadow()
+	}
+	return buffer.msync(0, metaSize)
+}
+
+// msync syncs the pages holding [from, to) of the mmapped file
+func (buffer *durableRingBuffer) msync(from, to uint64) error {
+	from &^= uint64(os.Getpagesize() - 1)
+	if from >= to {
+		return nil
+	}
+	region := buffer.mmappedFile[from:to]
+	_, _, errno := syscall.Syscall(syscall.SYS_MSYNC, uintptr(unsafe.Pointer(&region[0])), uintptr(len(region)), syscall.MS_SYNC)
+	if errno != 0 {
+		return syscall.Errno(errno)
+	}
+	return nil
+}
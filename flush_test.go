@@ -0,0 +1,88 @@
+package drbuffer
+
+import (
+	"os"
+	"testing"
+)
+
+func Test_flush_tracks_dirty_ranges(t *testing.T) {
+	assert := NewAssert(t)
+	buffer := openNew(assert)
+	defer buffer.Close()
+	durableBuffer := buffer.(*durableRingBuffer)
+	// everything is dirty after Open
+	assert(durableBuffer.dirty, "==", []recordSpan{{0, 1024}})
+	assert(buffer.Flush(), "==", nil)
+	assert(len(durableBuffer.dirty), "==", 0)
+	buffer.PushOne(make([]byte, 200))
+	buffer.PushOne(make([]byte, 200))
+	assert(durableBuffer.dirty, "==", []recordSpan{{0, 432}})
+	assert(buffer.Flush(), "==", nil)
+	buffer.PushOne(make([]byte, 200))
+	buffer.PushOne(make([]byte, 200))
+	assert(len(buffer.PopN(10)), "==", 4)
+	assert(buffer.Commit(), "==", nil)
+	// wraps, the end of previous lap and the start of this one
+	buffer.PushOne(make([]byte, 200))
+	assert(durableBuffer.dirty, "==", []recordSpan{{432, 864}, {0, 216}})
+	assert(buffer.Flush(), "==", nil)
+	assert(len(durableBuffer.dirty), "==", 0)
+	for i := 0; i < 8; i++ {
+		buffer.PushOne(make([]byte, 200))
+	}
+	// wrapped twice since last flush
+	assert(durableBuffer.dirty, "==", []recordSpan{{0, 1024}})
+	assert(buffer.Flush(), "==", nil)
+}
+
+func Test_flush_narrow_meta_section(t *testing.T) {
+	assert := NewAssert(t)
+	assert(ensureFileNotExist("/tmp/drbuffer"), "==", nil)
+	content := make([]byte, 8192)
+	content[0] = 3
+	assert(os.WriteFile("/tmp/drbuffer", content, 0644), "==", nil)
+	buffer, err := Open("/tmp/drbuffer", 1)
+	assert(err, "==", nil)
+	assert(buffer.Flush(), "==", nil)
+	for i := 0; i < 20; i++ {
+		buffer.PushOne(make([]byte, 1000))
+	}
+	assert(buffer.Flush(), "==", nil)
+	assert(buffer.Close(), "==", nil)
+	buffer, err = Open("/tmp/drbuffer", 1)
+	assert(err, "==", nil)
+	defer buffer.Close()
+	assert(buffer.RecoveryReport().Repaired(), "==", false)
+}
+
+func benchmarkFlush(b *testing.B, flushAll bool) {
+	os.Remove("/tmp/drbuffer-bench")
+	buffer, err := Open("/tmp/drbuffer-bench", 64*1024)
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer os.Remove("/tmp/drbuffer-bench")
+	defer buffer.Close()
+	packet := make([]byte, 1024)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		buffer.PushOne(packet)
+		buffer.PopOne()
+		if flushAll {
+			buffer.(*durableRingBuffer).markAllDirty()
+		}
+		if err := buffer.Flush(); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+// BenchmarkFlush syncs the pages of one packet and the meta section
+func BenchmarkFlush(b *testing.B) {
+	benchmarkFlush(b, false)
+}
+
+// BenchmarkFlushAll syncs the whole 64MiB mapping, as Flush did before tracking dirty ranges
+func BenchmarkFlushAll(b *testing.B) {
+	benchmarkFlush(b, true)
+}
@@ -0,0 +1,4 @@
+module github.com/dulumao/drbuffer
+
+// 1.23 for iter.Seq of the iterator API
+go 1.23
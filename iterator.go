@@ -0,0 +1,216 @@
+package drbuffer
+
+import (
+	"fmt"
+	"iter"
+)
+
+// SeekTarget tells where Seek moves the iterator to
+type SeekTarget int
+
+const (
+	SeekOldest SeekTarget = iota // the oldest packet not committed by every consumer
+	SeekNewest                   // after the last pushed packet, only packets pushed later will be seen
+	SeekOffset                   // the record starting at the offset in the data section
+)
+
+// ITERATOR_CHUNK_SIZE is how many packets the iterator copies every time it takes the lock
+const ITERATOR_CHUNK_SIZE = 64
+
+// Iterator walks the packets without moving any consumer.
+// the packets it passes are not protected from overwrite, the overwritten ones are skipped
+type Iterator struct {
+	buffer   *durableRingBuffer
+	readFrom uint64
+}
+
+// Iterator starts from the next packet PopN of the consumer would return
+func (consumer *durableConsumer) Iterator() *Iterator {
+	consumer.buffer.lock.Lock()
+	defer consumer.buffer.lock.Unlock()
+	return &Iterator{buffer: consumer.buffer, readFrom: consumer.cursor.nextReadFrom}
+}
+
+// All yields the packets PopN of the consumer would return, without popping them
+func (consumer *durableConsumer) All() iter.Seq[[]byte] {
+	return consumer.Iterator().All()
+}
+
+// Peek returns copies of up to n packets PopN of the consumer would return, without popping them
+func (consumer *durableConsumer) Peek(maxPacketsCount int) ([][]byte, error) {
+	return consumer.Iterator().Peek(maxPacketsCount)
+}
+
+// Offset is where the next packet starts in the data section, Seek with SeekOffset comes back to it
+func (iterator *Iterator) Offset() uint64 {
+	return iterator.readFrom
+}
+
+func (iterator *Iterator) Seek(target SeekTarget, offset uint64) error {
+	buffer := iterator.buffer
+	buffer.lock.Lock()
+	defer buffer.lock.Unlock()
+	if buffer.closed {
+		return ErrClosed
+	}
+	switch target {
+	case SeekOldest:
+		iterator.readFrom = buffer.oldestReadTo()
+	case SeekNewest:
+		iterator.readFrom = buffer.nextWriteFrom.load()
+	case SeekOffset:
+		if offset != buffer.nextWriteFrom.load() {
+			if offset >= uint64(len(buffer.data)) {
+				return fmt.Errorf("offset %d is beyond the data section of %d bytes", offset, len(buffer.data))
+			}
+			if _, _, reason := buffer.format.read(buffer.data[offset:]); reason != "" {
+				return fmt.Errorf("no valid record at offset %d: %s", offset, reason)
+			}
+		}
+		iterator.readFrom = offset
+	default:
+		return fmt.Errorf("unknown seek target: %d", target)
+	}
+	return nil
+}
+
+// Peek returns copies of up to n packets from the iterator position, the position does not move
+func (iterator *Iterator) Peek(maxPacketsCount int) ([][]byte, error) {
+	buffer := iterator.buffer
+	buffer.lock.Lock()
+	defer buffer.lock.Unlock()
+	if buffer.closed {
+		return nil, ErrClosed
+	}
+	packets, _, err := buffer.peek(iterator.readFrom, maxPacketsCount)
+	return copyPackets(packets), err
+}
+
+// All yields copies of the packets from the iterator position up to the last pushed one, moving the position.
+// the lock is not held while yielding, so the loop body can push and pop the buffer.
+// when the writer laps the iterator meanwhile, it goes on after the overwritten packets like a consumer,
+// the packets yielded but not overwritten may be yielded again if the loop stops then.
+// across processes the iterator is not moved, only the checksum tells an overwritten record
+func (iterator *Iterator) All() iter.Seq[[]byte] {
+	return func(yield func([]byte) bool) {
+		reader, ok := iterator.follow()
+		if !ok {
+			return
+		}
+		defer iterator.unfollow(reader)
+		for {
+			packets, chunkFrom, rewinds, ok := iterator.nextChunk(reader)
+			if !ok {
+				return
+			}
+			for i, packet := range packets {
+				if !yield(packet) {
+					// stopped in the middle of the chunk, only move after the yielded packets
+					iterator.buffer.stopAfter(reader, chunkFrom, rewinds, i+1)
+					return
+				}
+			}
+		}
+	}
+}
+
+// follow registers a reader at the iterator position for write to move, ok is false if closed
+func (iterator *Iterator) follow() (*cursor, bool) {
+	buffer := iterator.buffer
+	buffer.lock.Lock()
+	defer buffer.lock.Unlock()
+	if buffer.closed {
+		return nil, false
+	}
+	lastReadTo := metaField{wide: new(uint64)}
+	lastReadTo.store(iterator.readFrom)
+	reader := buffer.newCursor("", lastReadTo, metaField{wide: new(uint64)}, metaField{wide: new(uint64)})
+	buffer.iterators = append(buffer.iterators, reader)
+	return reader, true
+}
+
+func (iterator *Iterator) unfollow(reader *cursor) {
+	buffer := iterator.buffer
+	buffer.lock.Lock()
+	defer buffer.lock.Unlock()
+	iterator.readFrom = reader.nextReadFrom
+	for i, follower := range buffer.iterators {
+		if follower == reader {
+			buffer.iterators = append(buffer.iterators[:i], buffer.iterators[i+1:]...)
+			break
+		}
+	}
+}
+
+// nextChunk moves the reader after the packets returned, ok is false at the end.
+// lastReadTo stays at the start of the chunk, so the chunk is not overwritten without moving the reader
+func (iterator *Iterator) nextChunk(reader *cursor) ([][]byte, uint64, uint64, bool) {
+	buffer := iterator.buffer
+	buffer.lock.Lock()
+	defer buffer.lock.Unlock()
+	for !buffer.closed {
+		reader.Commit()
+		chunkFrom := reader.nextReadFrom
+		packets, err := reader.readN(ITERATOR_CHUNK_SIZE)
+		if len(packets) == 0 && err == nil {
+			return nil, 0, 0, false
+		}
+		if len(packets) > 0 {
+			return copyPackets(packets), chunkFrom, reader.rewinds, true
+		}
+		// only skipped a corrupted region, keep going
+	}
+	return nil, 0, 0, false
+}
+
+// stopAfter moves the reader after packetsCount packets from chunkFrom,
+// unless it was moved past the overwritten packets since
+func (buffer *durableRingBuffer) stopAfter(reader *cursor, chunkFrom uint64, rewinds uint64, packetsCount int) {
+	buffer.lock.Lock()
+	defer buffer.lock.Unlock()
+	if buffer.closed {
+		return
+	}
+	if reader.rewinds != rewinds {
+		reader.nextReadFrom = reader.lastReadTo.load()
+		return
+	}
+	_, readTo, _ := buffer.peek(chunkFrom, packetsCount)
+	reader.nextReadFrom = readTo
+}
+
+// peek reads like a consumer at readFrom would, without moving any cursor
+func (buffer *ringBuffer) peek(readFrom uint64, maxPacketsCount int) ([][]byte, uint64, error) {
+	if maxPacketsCount > MAX_PACKETS_READ_ONE_TIME {
+		maxPacketsCount = MAX_PACKETS_READ_ONE_TIME
+	}
+	if maxPacketsCount < 0 {
+		maxPacketsCount = 0
+	}
+	reader := &cursor{
+		ring:                 buffer,
+		nextReadFrom:         readFrom,
+		reusablePacketList:   make([][]byte, maxPacketsCount),
+		reusableSequenceList: make([]uint64, maxPacketsCount),
+	}
+	packets, err := reader.readN(maxPacketsCount)
+	return packets, reader.nextReadFrom, err
+}
+
+// oldestReadTo is the position of the consumer furthest behind, previous lap comes before the current one
+func (buffer *ringBuffer) oldestReadTo() uint64 {
+	nextWriteFrom := buffer.nextWriteFrom.load()
+	oldest := nextWriteFrom
+	for _, cursor := range buffer.cursors {
+		lastReadTo := cursor.lastReadTo.load()
+		inPreviousLap := lastReadTo > nextWriteFrom
+		if inPreviousLap != (oldest > nextWriteFrom) {
+			if inPreviousLap {
+				oldest = lastReadTo
+			}
+		} else if lastReadTo < oldest {
+			oldest = lastReadTo
+		}
+	}
+	return oldest
+}
@@ -0,0 +1,153 @@
+package drbuffer
+
+import (
+	"encoding/binary"
+	"fmt"
+	"slices"
+	"testing"
+)
+
+func Test_all_does_not_consume(t *testing.T) {
+	assert := NewAssert(t)
+	assert(ensureFileNotExist("/tmp/drbuffer_iterator"), "==", nil)
+	buffer, err := Open("/tmp/drbuffer_iterator", 1)
+	assert(err, "==", nil)
+	defer buffer.Close()
+	buffer.PushN([][]byte{
+		[]byte("A"),
+		[]byte("B"),
+		[]byte("C"),
+	})
+	seen := ""
+	for packet := range buffer.All() {
+		seen += string(packet)
+		// the lock is not held by the iterator
+		buffer.PushOne([]byte("D"))
+		if len(seen) == 3 {
+			break
+		}
+	}
+	assert(seen, "==", "ABC")
+	assert(len(buffer.PopN(10)), "==", 6)
+}
+
+func Test_peek(t *testing.T) {
+	assert := NewAssert(t)
+	assert(ensureFileNotExist("/tmp/drbuffer_iterator"), "==", nil)
+	buffer, err := Open("/tmp/drbuffer_iterator", 1)
+	assert(err, "==", nil)
+	defer buffer.Close()
+	buffer.PushN([][]byte{
+		[]byte("A"),
+		[]byte("B"),
+		[]byte("C"),
+	})
+	packets, err := buffer.Peek(2)
+	assert(err, "==", nil)
+	assert(len(packets), "==", 2)
+	assert(string(packets[1]), "==", "B")
+	assert(string(buffer.PopOne()), "==", "A")
+	packets, err = buffer.Peek(10)
+	assert(err, "==", nil)
+	assert(len(packets), "==", 2)
+	assert(string(packets[0]), "==", "B")
+}
+
+func Test_seek(t *testing.T) {
+	assert := NewAssert(t)
+	assert(ensureFileNotExist("/tmp/drbuffer_iterator"), "==", nil)
+	buffer, err := Open("/tmp/drbuffer_iterator", 1)
+	assert(err, "==", nil)
+	defer buffer.Close()
+	buffer.PushN([][]byte{
+		[]byte("A"),
+		[]byte("B"),
+		[]byte("C"),
+	})
+	assert(len(buffer.PopN(2)), "==", 2)
+	iterator := buffer.Iterator()
+	assert(joinPackets(iterator.All()), "==", "C")
+	// popped but not committed
+	assert(iterator.Seek(SeekOldest, 0), "==", nil)
+	assert(joinPackets(iterator.All()), "==", "ABC")
+	assert(iterator.Seek(SeekNewest, 0), "==", nil)
+	assert(joinPackets(iterator.All()), "==", "")
+	buffer.PushOne([]byte("D"))
+	assert(joinPackets(iterator.All()), "==", "D")
+	assert(iterator.Seek(SeekOldest, 0), "==", nil)
+	for range iterator.All() {
+		break
+	}
+	offsetOfB := iterator.Offset()
+	iterator = buffer.Iterator()
+	assert(iterator.Seek(SeekOffset, offsetOfB), "==", nil)
+	assert(joinPackets(iterator.All()), "==", "BCD")
+	assert(iterator.Seek(SeekOffset, offsetOfB+1), "!=", nil)
+	assert(iterator.Offset(), "==", buffer.(*durableRingBuffer).nextWriteFrom.load())
+}
+
+func Test_all_follows_wrap(t *testing.T) {
+	assert := NewAssert(t)
+	assert(ensureFileNotExist("/tmp/drbuffer_iterator"), "==", nil)
+	buffer, err := Open("/tmp/drbuffer_iterator", 1)
+	assert(err, "==", nil)
+	defer buffer.Close()
+	for i := 0; i < 4; i++ {
+		buffer.PushOne([]byte(fmt.Sprintf("%d%s", i, make([]byte, 199))))
+	}
+	assert(len(buffer.PopN(2)), "==", 2)
+	assert(buffer.Commit(), "==", nil)
+	buffer.PushOne([]byte(fmt.Sprintf("%d%s", 4, make([]byte, 199))))
+	// 2 and 3 are at the end of previous lap
+	assert(buffer.(*durableRingBuffer).wrapAt.load(), "!=", uint64(0))
+	seen := ""
+	for packet := range buffer.All() {
+		seen += string(packet[:1])
+	}
+	popped := ""
+	for _, packet := range buffer.PopN(10) {
+		popped += string(packet[:1])
+	}
+	assert(seen, "==", popped)
+	assert(seen, "==", "234")
+}
+
+func Test_all_moves_past_overwritten_packets(t *testing.T) {
+	assert := NewAssert(t)
+	assert(ensureFileNotExist("/tmp/drbuffer_iterator"), "==", nil)
+	buffer, err := Open("/tmp/drbuffer_iterator", 4)
+	assert(err, "==", nil)
+	defer buffer.Close()
+	pushNumbers := func(from, to int) {
+		for i := from; i < to; i++ {
+			packet := make([]byte, 2)
+			binary.LittleEndian.PutUint16(packet, uint16(i))
+			buffer.PushOne(packet)
+		}
+	}
+	pushNumbers(0, 100)
+	seen := []int{}
+	for packet := range buffer.All() {
+		if len(seen) == 0 {
+			// laps the rest of the first chunk and what follows it
+			pushNumbers(100, 360)
+		}
+		seen = append(seen, int(binary.LittleEndian.Uint16(packet)))
+	}
+	assert(len(seen) < 360, "==", true)
+	for i := 1; i < len(seen); i++ {
+		assert(seen[i] > seen[i-1], "==", true)
+	}
+	// the end of previous lap is not overwritten
+	assert(slices.Contains(seen, 226), "==", true)
+	assert(seen[len(seen)-1], "==", 359)
+	assert(len(buffer.(*durableRingBuffer).iterators), "==", 0)
+}
+
+func joinPackets(packets func(func([]byte) bool)) string {
+	joined := ""
+	for packet := range packets {
+		joined += string(packet)
+	}
+	return joined
+}
@@ -0,0 +1,50 @@
+package drbuffer
+
+import (
+	"errors"
+	"os"
+	"syscall"
+	"time"
+)
+
+var ErrLocked = errors.New("buffer is locked by another process")
+
+// LOCK_POLL_INTERVAL is how often Open retries the lock when waiting with WithLockTimeout
+const LOCK_POLL_INTERVAL = 10 * time.Millisecond
+
+// the roles lock one byte each at the start of the file,
+// so one producer and one consumer can share the file but not two of either
+const producerLockByte = 0
+const consumerLockByte = 1
+
+// lockRange returns the bytes exclusively locked for the role
+func lockRange(role Role) (start int64, length int64) {
+	switch role {
+	case ProduceOnly:
+		return producerLockByte, 1
+	case ConsumeOnly:
+		return consumerLockByte, 1
+	default:
+		return producerLockByte, 2
+	}
+}
+
+// lockFile takes the advisory lock of the role, waiting up to timeout for it
+func lockFile(fileObj *os.File, role Role, timeout time.Duration) error {
+	start, length := lockRange(role)
+	lock := syscall.Flock_t{Type: syscall.F_WRLCK, Whence: 0, Start: start, Len: length}
+	deadline := time.Now().Add(timeout)
+	for {
+		err := syscall.FcntlFlock(fileObj.Fd(), fcntlSetLock, &lock)
+		if err == nil {
+			return nil
+		}
+		if err != syscall.EAGAIN && err != syscall.EACCES {
+			return annotatedError{err, "failed to lock file"}
+		}
+		if !time.Now().Before(deadline) {
+			return ErrLocked
+		}
+		time.Sleep(LOCK_POLL_INTERVAL)
+	}
+}
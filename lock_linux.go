@@ -0,0 +1,5 @@
+package drbuffer
+
+// F_OFD_SETLK, the lock belongs to the open file, so it conflicts with another Open in the same process too,
+// and closing an unrelated descriptor of the same file does not release it
+const fcntlSetLock = 37
@@ -0,0 +1,96 @@
+package drbuffer
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func Test_second_writer_is_locked_out(t *testing.T) {
+	assert := NewAssert(t)
+	assert(ensureFileNotExist("/tmp/drbuffer_lock"), "==", nil)
+	buffer, err := Open("/tmp/drbuffer_lock", 1)
+	assert(err, "==", nil)
+	_, err = Open("/tmp/drbuffer_lock", 1)
+	assert(err, "==", ErrLocked)
+	_, err = Open("/tmp/drbuffer_lock", 1, WithRole(ProduceOnly), WithOverflowPolicy(RejectNewest))
+	assert(err, "==", ErrLocked)
+	_, err = Open("/tmp/drbuffer_lock", 1, WithRole(ConsumeOnly))
+	assert(err, "==", ErrLocked)
+	assert(buffer.Close(), "==", nil)
+	buffer, err = Open("/tmp/drbuffer_lock", 1)
+	assert(err, "==", nil)
+	assert(buffer.Close(), "==", nil)
+}
+
+func Test_producer_and_consumer_roles_lock_separately(t *testing.T) {
+	assert := NewAssert(t)
+	assert(ensureFileNotExist("/tmp/drbuffer_lock"), "==", nil)
+	producer, err := Open("/tmp/drbuffer_lock", 1, WithRole(ProduceOnly), WithOverflowPolicy(RejectNewest))
+	assert(err, "==", nil)
+	defer producer.Close()
+	consumer, err := Open("/tmp/drbuffer_lock", 1, WithRole(ConsumeOnly))
+	assert(err, "==", nil)
+	defer consumer.Close()
+	_, err = Open("/tmp/drbuffer_lock", 1, WithRole(ConsumeOnly))
+	assert(err, "==", ErrLocked)
+	_, err = Open("/tmp/drbuffer_lock", 1, WithRole(ProduceOnly), WithOverflowPolicy(RejectNewest))
+	assert(err, "==", ErrLocked)
+}
+
+func Test_wait_for_lock_with_timeout(t *testing.T) {
+	assert := NewAssert(t)
+	assert(ensureFileNotExist("/tmp/drbuffer_lock"), "==", nil)
+	buffer, err := Open("/tmp/drbuffer_lock", 1)
+	assert(err, "==", nil)
+	_, err = Open("/tmp/drbuffer_lock", 1, WithLockTimeout(30*time.Millisecond))
+	assert(err, "==", ErrLocked)
+	go func() {
+		time.Sleep(50 * time.Millisecond)
+		buffer.Close()
+	}()
+	buffer, err = Open("/tmp/drbuffer_lock", 1, WithLockTimeout(5*time.Second))
+	assert(err, "==", nil)
+	assert(buffer.Close(), "==", nil)
+}
+
+func Test_producer_and_consumer_create_missing_file_together(t *testing.T) {
+	assert := NewAssert(t)
+	for i := 0; i < 100; i++ {
+		// large enough for the one creating it to be caught writing the zeros
+		assert(ensureFileNotExist("/tmp/drbuffer_lock"), "==", nil)
+		start := make(chan struct{})
+		var consumer DurableRingBuffer
+		consumerErr := make(chan error, 1)
+		go func() {
+			<-start
+			var err error
+			consumer, err = Open("/tmp/drbuffer_lock", 1024, WithRole(ConsumeOnly))
+			consumerErr <- err
+		}()
+		close(start)
+		producer, err := Open("/tmp/drbuffer_lock", 1024, WithRole(ProduceOnly), WithOverflowPolicy(RejectNewest))
+		assert(err, "==", nil)
+		assert(<-consumerErr, "==", nil)
+		assert(producer.Push([]byte("A")), "==", nil)
+		packets := consumer.PopN(10)
+		assert(len(packets), "==", 1)
+		assert(string(packets[0]), "==", "A")
+		assert(producer.Close(), "==", nil)
+		assert(consumer.Close(), "==", nil)
+	}
+	matches, _ := filepath.Glob("/tmp/drbuffer_lock.creating*")
+	assert(len(matches), "==", 0)
+}
+
+func Test_created_file_readable_by_others(t *testing.T) {
+	assert := NewAssert(t)
+	assert(ensureFileNotExist("/tmp/drbuffer_lock"), "==", nil)
+	buffer, err := Open("/tmp/drbuffer_lock", 1)
+	assert(err, "==", nil)
+	assert(buffer.Close(), "==", nil)
+	fi, err := os.Stat("/tmp/drbuffer_lock")
+	assert(err, "==", nil)
+	assert(fi.Mode().Perm(), "==", os.FileMode(0644))
+}
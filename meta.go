@@ -0,0 +1,135 @@
+package drbuffer
+
+import (
+	"fmt"
+	"sync/atomic"
+	"unsafe"
+)
+
+// versions 1 to 3 share the narrow meta section:
+// [4 version][4 nextWriteFrom][4 lastReadTo][4 wrapAt]
+// version 4 uses the wide meta section, padded to one page so the data section starts page aligned:
+// [4 version][4 reserved][8 nextWriteFrom][8 lastReadTo][8 wrapAt][8 lastSequence]
+// [8 totalPushed][8 totalPopped][8 droppedPackets][8 wraps][8 spillReadFrom][48 reserved]
+// [384 reserved][512 shadow slot][512 shadow slot][consumer table], see SHADOW_META_OFFSET and CONSUMER_TABLE_OFFSET
+// lastSequence is only used since version 5
+const META_SECTION_SIZE = 16
+const WIDE_META_SECTION_SIZE = 4096
+const FIRST_WIDE_VERSION = 4
+
+func metaSectionSize(version uint32) int {
+	if version >= FIRST_WIDE_VERSION {
+		return WIDE_META_SECTION_SIZE
+	}
+	return META_SECTION_SIZE
+}
+
+// metaField is an offset stored in the meta section, it is 32 bits before version 4 and 64 bits since.
+// it is loaded and stored atomically, the other process mapping the file sees the data written before it moved
+type metaField struct {
+	narrow *uint32
+	wide   *uint64
+}
+
+func newMetaField(meta []byte, version uint32, narrowOffset int, wideOffset int) metaField {
+	if version >= FIRST_WIDE_VERSION {
+		return metaField{wide: (*uint64)(unsafe.Pointer(&meta[wideOffset]))}
+	}
+	return metaField{narrow: (*uint32)(unsafe.Pointer(&meta[narrowOffset]))}
+}
+
+// newCounterField keeps the counter in memory before version 4, there is no room for it in the narrow meta section
+func newCounterField(meta []byte, version uint32, wideOffset int) metaField {
+	if version >= FIRST_WIDE_VERSION {
+		return newMetaField(meta, version, 0, wideOffset)
+	}
+	return metaField{wide: new(uint64)}
+}
+
+func (field metaField) add(delta uint64) {
+	if field.wide != nil {
+		atomic.AddUint64(field.wide, delta)
+	} else {
+		atomic.AddUint32(field.narrow, uint32(delta))
+	}
+}
+
+func (field metaField) load() uint64 {
+	if field.wide != nil {
+		return atomic.LoadUint64(field.wide)
+	}
+	return uint64(atomic.LoadUint32(field.narrow))
+}
+
+func (field metaField) store(value uint64) {
+	if field.wide != nil {
+		atomic.StoreUint64(field.wide, value)
+	} else {
+		atomic.StoreUint32(field.narrow, uint32(value))
+	}
+}
+
+func readVersion(meta []byte) uint32 {
+	return *(*uint32)(unsafe.Pointer(&meta[0]))
+}
+
+func checkVersion(version uint32) error {
+	if _, found := recordFormats[version]; !found {
+		return fmt.Errorf("unsupported file version: %d", version)
+	}
+	return nil
+}
+
+// Meta is a snapshot of the meta section
+type Meta struct {
+	Version       uint32
+	DataSize      uint64
+	NextWriteFrom uint64
+	LastReadTo    uint64
+	WrapAt        uint64
+	LastSequence  uint64 // 0 before version 5
+	Consumers     []ConsumerMeta
+	Stats         Stats
+}
+
+type ConsumerMeta struct {
+	Name           string
+	LastReadTo     uint64
+	DroppedPackets uint64
+	PoppedPackets  uint64
+}
+
+// ReadMeta takes a snapshot of the meta section, without locking or changing the file
+func ReadMeta(filePath string) (Meta, error) {
+	buffer, err := Open(filePath, 0, WithRole(ReadOnly))
+	if err != nil {
+		return Meta{}, err
+	}
+	defer buffer.Close()
+	durableBuffer := buffer.(*durableRingBuffer)
+	meta := durableBuffer.snapshotMeta()
+	meta.Stats = buffer.Stats()
+	return meta, nil
+}
+
+func (buffer *ringBuffer) snapshotMeta() Meta {
+	meta := Meta{
+		Version:       *buffer.version,
+		DataSize:      uint64(len(buffer.data)),
+		NextWriteFrom: buffer.nextWriteFrom.load(),
+		LastReadTo:    buffer.lastReadTo.load(),
+		WrapAt:        buffer.wrapAt.load(),
+	}
+	if buffer.format.sequenced {
+		meta.LastSequence = buffer.lastSequence.load()
+	}
+	for _, cursor := range buffer.cursors[1:] {
+		meta.Consumers = append(meta.Consumers, ConsumerMeta{
+			Name:           cursor.name,
+			LastReadTo:     cursor.lastReadTo.load(),
+			DroppedPackets: cursor.droppedPackets.load(),
+			PoppedPackets:  cursor.poppedPackets.load(),
+		})
+	}
+	return meta
+}
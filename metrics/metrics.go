@@ -0,0 +1,143 @@
+// Package metrics exports the stats of registered buffers through expvar and the Prometheus text format
+package metrics
+
+import (
+	"expvar"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/dulumao/drbuffer"
+)
+
+// StatsSource is implemented by drbuffer.DurableRingBuffer
+type StatsSource interface {
+	Stats() drbuffer.Stats
+}
+
+// Registry holds the buffers by name, a buffer should be unregistered before it is closed
+type Registry struct {
+	lock    sync.Mutex
+	buffers map[string]StatsSource
+}
+
+// Default is published to expvar as "drbuffer"
+var Default = NewRegistry()
+
+func init() {
+	expvar.Publish("drbuffer", Default.Var())
+}
+
+func NewRegistry() *Registry {
+	return &Registry{buffers: map[string]StatsSource{}}
+}
+
+func Register(name string, buffer StatsSource) error {
+	return Default.Register(name, buffer)
+}
+
+func Unregister(name string) {
+	Default.Unregister(name)
+}
+
+// Handler serves the Default registry in the Prometheus text format
+func Handler() http.Handler {
+	return Default
+}
+
+func (registry *Registry) Register(name string, buffer StatsSource) error {
+	registry.lock.Lock()
+	defer registry.lock.Unlock()
+	if _, found := registry.buffers[name]; found {
+		return fmt.Errorf("buffer already registered: %q", name)
+	}
+	registry.buffers[name] = buffer
+	return nil
+}
+
+func (registry *Registry) Unregister(name string) {
+	registry.lock.Lock()
+	defer registry.lock.Unlock()
+	delete(registry.buffers, name)
+}
+
+// Stats returns the stats of every registered buffer by name
+func (registry *Registry) Stats() map[string]drbuffer.Stats {
+	registry.lock.Lock()
+	defer registry.lock.Unlock()
+	stats := make(map[string]drbuffer.Stats, len(registry.buffers))
+	for name, buffer := range registry.buffers {
+		stats[name] = buffer.Stats()
+	}
+	return stats
+}
+
+// Var renders the stats as a JSON object by buffer name
+func (registry *Registry) Var() expvar.Var {
+	return expvar.Func(func() any {
+		return registry.Stats()
+	})
+}
+
+type metric struct {
+	name  string
+	kind  string
+	help  string
+	value func(stats drbuffer.Stats) float64
+}
+
+var metricList = []metric{
+	{"drbuffer_pending_packets", "gauge", "Packets the default consumer has not popped.",
+		func(stats drbuffer.Stats) float64 { return float64(stats.PendingPackets) }},
+	{"drbuffer_pending_bytes", "gauge", "Bytes of the records the default consumer has not popped.",
+		func(stats drbuffer.Stats) float64 { return float64(stats.PendingBytes) }},
+	{"drbuffer_free_bytes", "gauge", "Bytes not holding packets uncommitted by any consumer.",
+		func(stats drbuffer.Stats) float64 { return float64(stats.FreeBytes) }},
+	{"drbuffer_capacity_bytes", "gauge", "Bytes of the data section.",
+		func(stats drbuffer.Stats) float64 { return float64(stats.Capacity) }},
+	{"drbuffer_pushed_packets_total", "counter", "Packets pushed.",
+		func(stats drbuffer.Stats) float64 { return float64(stats.TotalPushed) }},
+	{"drbuffer_popped_packets_total", "counter", "Packets popped by the default consumer.",
+		func(stats drbuffer.Stats) float64 { return float64(stats.TotalPopped) }},
+	{"drbuffer_dropped_packets_total", "counter", "Packets overwritten before popped by the default consumer.",
+		func(stats drbuffer.Stats) float64 { return float64(stats.DroppedPackets) }},
+	{"drbuffer_wraps_total", "counter", "Times the writer wrapped around.",
+		func(stats drbuffer.Stats) float64 { return float64(stats.Wraps) }},
+}
+
+// ServeHTTP writes the stats in the Prometheus text format, labelled by buffer name
+func (registry *Registry) ServeHTTP(writer http.ResponseWriter, request *http.Request) {
+	writer.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	registry.WriteTo(writer)
+}
+
+// WriteTo writes the stats in the Prometheus text format
+func (registry *Registry) WriteTo(writer io.Writer) (int64, error) {
+	stats := registry.Stats()
+	names := make([]string, 0, len(stats))
+	for name := range stats {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	text := &strings.Builder{}
+	for _, metric := range metricList {
+		fmt.Fprintf(text, "# HELP %s %s\n# TYPE %s %s\n", metric.name, metric.help, metric.name, metric.kind)
+		for _, name := range names {
+			fmt.Fprintf(text, "%s{buffer=\"%s\"} %v\n", metric.name, escapeLabel(name), metric.value(stats[name]))
+		}
+	}
+	text.WriteString("# HELP drbuffer_flush_seconds Time spent in Flush.\n# TYPE drbuffer_flush_seconds summary\n")
+	for _, name := range names {
+		fmt.Fprintf(text, "drbuffer_flush_seconds_sum{buffer=\"%s\"} %v\n", escapeLabel(name), stats[name].FlushDuration.Seconds())
+		fmt.Fprintf(text, "drbuffer_flush_seconds_count{buffer=\"%s\"} %d\n", escapeLabel(name), stats[name].Flushes)
+	}
+	written, err := io.WriteString(writer, text.String())
+	return int64(written), err
+}
+
+func escapeLabel(value string) string {
+	return strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`).Replace(value)
+}
@@ -0,0 +1,87 @@
+package metrics
+
+import (
+	"encoding/json"
+	"io"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/dulumao/drbuffer"
+)
+
+type fixedStats drbuffer.Stats
+
+func (stats fixedStats) Stats() drbuffer.Stats {
+	return drbuffer.Stats(stats)
+}
+
+func Test_prometheus_handler(t *testing.T) {
+	registry := NewRegistry()
+	if err := registry.Register("orders", fixedStats{PendingPackets: 3, TotalPushed: 10, DroppedPackets: 2, Flushes: 4, FlushDuration: 2 * time.Second}); err != nil {
+		t.Fatal(err)
+	}
+	if err := registry.Register(`say "hi"`, fixedStats{}); err != nil {
+		t.Fatal(err)
+	}
+	if err := registry.Register("orders", fixedStats{}); err == nil {
+		t.Fatal("registered the same name twice")
+	}
+	server := httptest.NewServer(registry)
+	defer server.Close()
+	response, err := server.Client().Get(server.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer response.Body.Close()
+	if !strings.HasPrefix(response.Header.Get("Content-Type"), "text/plain; version=0.0.4") {
+		t.Fatal("unexpected content type:", response.Header.Get("Content-Type"))
+	}
+	body, _ := io.ReadAll(response.Body)
+	for _, line := range []string{
+		"# TYPE drbuffer_pending_packets gauge",
+		`drbuffer_pending_packets{buffer="orders"} 3`,
+		`drbuffer_pushed_packets_total{buffer="orders"} 10`,
+		`drbuffer_dropped_packets_total{buffer="orders"} 2`,
+		`drbuffer_flush_seconds_sum{buffer="orders"} 2`,
+		`drbuffer_flush_seconds_count{buffer="orders"} 4`,
+		`drbuffer_pending_packets{buffer="say \"hi\""} 0`,
+	} {
+		if !strings.Contains(string(body), line+"\n") {
+			t.Errorf("missing %q in:\n%s", line, body)
+		}
+	}
+	registry.Unregister("orders")
+	recorder := httptest.NewRecorder()
+	registry.ServeHTTP(recorder, httptest.NewRequest("GET", "/metrics", nil))
+	if strings.Contains(recorder.Body.String(), "orders") {
+		t.Error("unregistered buffer is still exported")
+	}
+}
+
+func Test_expvar_of_open_buffer(t *testing.T) {
+	os.Remove("/tmp/drbuffer_metrics")
+	buffer, err := drbuffer.Open("/tmp/drbuffer_metrics", 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer buffer.Close()
+	buffer.PushOne([]byte("Hello"))
+	if err := buffer.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	if err := Register("metrics_test", buffer); err != nil {
+		t.Fatal(err)
+	}
+	defer Unregister("metrics_test")
+	exported := map[string]drbuffer.Stats{}
+	if err := json.Unmarshal([]byte(Default.Var().String()), &exported); err != nil {
+		t.Fatal(err)
+	}
+	stats := exported["metrics_test"]
+	if stats.PendingPackets != 1 || stats.TotalPushed != 1 || stats.Flushes != 1 {
+		t.Errorf("unexpected stats: %+v", stats)
+	}
+}
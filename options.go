@@ -0,0 +1,116 @@
+package drbuffer
+
+import "time"
+
+type options struct {
+	overflowPolicy  OverflowPolicy
+	copyPackets     bool
+	role            Role
+	lockTimeout     time.Duration
+	autoGrow        bool
+	spillPath       string
+	evictionHandler EvictionHandler
+	syncPolicy      SyncPolicy
+	pollInterval    time.Duration
+	uncheckedMeta   bool // Verify reports the pointers out of range instead of failing
+}
+
+// Role tells which side of the buffer this process uses
+type Role int
+
+const (
+	ProduceAndConsume Role = iota // the only process using the file
+	ProduceOnly                   // pushes while another process pops the same file
+	ConsumeOnly                   // pops while another process pushes the same file
+	ReadOnly                      // only looks at the existing file with Peek, All and Iterator, takes no lock
+)
+
+// Option customizes how Open sets up the buffer
+type Option func(*options)
+
+// WithOverflowPolicy defaults to OverwriteOldest
+func WithOverflowPolicy(policy OverflowPolicy) Option {
+	return func(opts *options) {
+		opts.overflowPolicy = policy
+	}
+}
+
+// WithCopiedPackets makes popped packets copies owned by the caller,
+// so goroutines can keep them while others push and pop the same buffer, the buffer is always locked either way.
+// without it, popped packets point into the mmapped file and are only valid until the next pop
+func WithCopiedPackets() Option {
+	return func(opts *options) {
+		opts.copyPackets = true
+	}
+}
+
+// WithRole defaults to ProduceAndConsume.
+// one ProduceOnly process and one ConsumeOnly process can share the file through the mmap,
+// the producer can not overwrite the consumer, so it must reject or block when full
+func WithRole(role Role) Option {
+	return func(opts *options) {
+		opts.role = role
+	}
+}
+
+// WithLockTimeout waits for the process holding the lock of the role to close the buffer,
+// Open returns ErrLocked right away by default
+func WithLockTimeout(timeout time.Duration) Option {
+	return func(opts *options) {
+		opts.lockTimeout = timeout
+	}
+}
+
+// WithAutoGrow resizes the existing file with less than nkiloBytes for packets before opening it,
+// by default nkiloBytes is ignored for an existing file
+func WithAutoGrow() Option {
+	return func(opts *options) {
+		opts.autoGrow = true
+	}
+}
+
+// WithSpillFile appends and syncs the packets OverwriteOldest drops for the default consumer to the file before they are overwritten,
+// DrainSpill hands them back in order. the file must be of version 4 or later
+func WithSpillFile(spillPath string) Option {
+	return func(opts *options) {
+		opts.spillPath = spillPath
+	}
+}
+
+// WithEvictionHandler passes the packets OverwriteOldest drops for the default consumer to the handler before they are overwritten,
+// after the spill file if both are set
+func WithEvictionHandler(handler EvictionHandler) Option {
+	return func(opts *options) {
+		opts.evictionHandler = handler
+	}
+}
+
+// WithSyncPolicy defaults to SyncManual
+func WithSyncPolicy(policy SyncPolicy) Option {
+	return func(opts *options) {
+		opts.syncPolicy = policy
+	}
+}
+
+// WithPollInterval defaults to CROSS_PROCESS_POLL_INTERVAL, a process waiting for the other one has to poll
+// as the other process can not wake it up
+func WithPollInterval(interval time.Duration) Option {
+	return func(opts *options) {
+		opts.pollInterval = interval
+	}
+}
+
+// withUncheckedMeta opens a file with the pointers out of range, only the size of the data section and the records can be trusted
+func withUncheckedMeta() Option {
+	return func(opts *options) {
+		opts.uncheckedMeta = true
+	}
+}
+
+func newOptions(optionList []Option) options {
+	opts := options{overflowPolicy: OverwriteOldest, pollInterval: CROSS_PROCESS_POLL_INTERVAL}
+	for _, option := range optionList {
+		option(&opts)
+	}
+	return opts
+}
@@ -0,0 +1,95 @@
+package drbuffer
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func Test_pop_wait_is_woken_by_push(t *testing.T) {
+	assert := NewAssert(t)
+	assert(ensureFileNotExist("/tmp/drbuffer_pop_wait"), "==", nil)
+	buffer, err := Open("/tmp/drbuffer_pop_wait", 1)
+	assert(err, "==", nil)
+	defer buffer.Close()
+	go func() {
+		time.Sleep(20 * time.Millisecond)
+		buffer.PushOne([]byte("A"))
+	}()
+	packets, err := buffer.PopWait(context.Background(), 10)
+	assert(err, "==", nil)
+	assert(len(packets), "==", 1)
+	assert(string(packets[0]), "==", "A")
+}
+
+func Test_pop_wait_returns_when_context_is_done(t *testing.T) {
+	assert := NewAssert(t)
+	assert(ensureFileNotExist("/tmp/drbuffer_pop_wait"), "==", nil)
+	buffer, err := Open("/tmp/drbuffer_pop_wait", 1)
+	assert(err, "==", nil)
+	defer buffer.Close()
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	packets, err := buffer.PopWait(ctx, 10)
+	assert(err, "==", context.DeadlineExceeded)
+	assert(len(packets), "==", 0)
+	// packets already there are returned without waiting
+	buffer.PushOne([]byte("A"))
+	packets, err = buffer.PopWait(context.Background(), 10)
+	assert(err, "==", nil)
+	assert(len(packets), "==", 1)
+}
+
+func Test_pop_wait_is_woken_by_close(t *testing.T) {
+	assert := NewAssert(t)
+	assert(ensureFileNotExist("/tmp/drbuffer_pop_wait"), "==", nil)
+	buffer, err := Open("/tmp/drbuffer_pop_wait", 1)
+	assert(err, "==", nil)
+	go func() {
+		time.Sleep(20 * time.Millisecond)
+		buffer.Close()
+	}()
+	_, err = buffer.PopWait(context.Background(), 10)
+	assert(err, "==", ErrClosed)
+}
+
+func Test_pop_wait_polls_producer_in_another_process(t *testing.T) {
+	assert := NewAssert(t)
+	assert(ensureFileNotExist("/tmp/drbuffer_pop_wait"), "==", nil)
+	producer, err := Open("/tmp/drbuffer_pop_wait", 1, WithRole(ProduceOnly), WithOverflowPolicy(RejectNewest))
+	assert(err, "==", nil)
+	defer producer.Close()
+	_, err = Open("/tmp/drbuffer_pop_wait", 1, WithRole(ConsumeOnly), WithPollInterval(0))
+	assert(err, "!=", nil)
+	consumer, err := Open("/tmp/drbuffer_pop_wait", 1, WithRole(ConsumeOnly), WithPollInterval(5*time.Millisecond))
+	assert(err, "==", nil)
+	defer consumer.Close()
+	assert(consumer.(*durableRingBuffer).pollInterval, "==", 5*time.Millisecond)
+	go func() {
+		time.Sleep(20 * time.Millisecond)
+		producer.PushOne([]byte("A"))
+	}()
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	packets, err := consumer.PopWait(ctx, 10)
+	assert(err, "==", nil)
+	assert(len(packets), "==", 1)
+	assert(string(packets[0]), "==", "A")
+}
+
+func Test_pop_wait_for_no_packets_returns_at_once(t *testing.T) {
+	assert := NewAssert(t)
+	assert(ensureFileNotExist("/tmp/drbuffer_pop_wait"), "==", nil)
+	buffer, err := Open("/tmp/drbuffer_pop_wait", 1)
+	assert(err, "==", nil)
+	defer buffer.Close()
+	buffer.PushOne([]byte("A"))
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	for _, maxPacketsCount := range []int{0, -1} {
+		packets, err := buffer.PopWait(ctx, maxPacketsCount)
+		assert(err, "==", nil)
+		assert(len(packets), "==", 0)
+	}
+	assert(string(buffer.PopOne()), "==", "A")
+}
@@ -0,0 +1,160 @@
+package drbuffer
+
+import (
+	"encoding/binary"
+	"fmt"
+	"os"
+	"os/exec"
+	"testing"
+	"time"
+)
+
+const crossProcessPackets = 20000
+
+// Test_cross_process_helper is the body of the forked producer and consumer, it does nothing when run directly
+func Test_cross_process_helper(t *testing.T) {
+	role := os.Getenv("DRBUFFER_TEST_ROLE")
+	if role == "" {
+		return
+	}
+	if err := runCrossProcessRole(role, os.Getenv("DRBUFFER_TEST_FILE")); err != nil {
+		fmt.Fprintln(os.Stderr, role, err)
+		os.Exit(1)
+	}
+}
+
+func runCrossProcessRole(role string, filePath string) error {
+	if role == "producer" {
+		buffer, err := Open(filePath, 4, WithRole(ProduceOnly), WithOverflowPolicy(BlockUntilSpace))
+		if err != nil {
+			return err
+		}
+		defer buffer.Close()
+		for i := 0; i < crossProcessPackets; i++ {
+			// vary the size, so the records wrap at different offsets
+			packet := make([]byte, 4+i%97)
+			binary.LittleEndian.PutUint32(packet, uint32(i))
+			if err := buffer.Push(packet); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	buffer, err := Open(filePath, 4, WithRole(ConsumeOnly))
+	if err != nil {
+		return err
+	}
+	defer buffer.Close()
+	deadline := time.Now().Add(30 * time.Second)
+	for expected := 0; expected < crossProcessPackets; {
+		if time.Now().After(deadline) {
+			return fmt.Errorf("timed out at packet %d", expected)
+		}
+		packets, err := buffer.PopNChecked(100)
+		if err != nil {
+			return err
+		}
+		if len(packets) == 0 {
+			time.Sleep(time.Millisecond)
+			continue
+		}
+		for _, packet := range packets {
+			if len(packet) != 4+expected%97 || binary.LittleEndian.Uint32(packet) != uint32(expected) {
+				return fmt.Errorf("expect packet %d, got %d bytes: %v", expected, len(packet), packet[:4])
+			}
+			expected += 1
+		}
+	}
+	return buffer.Commit()
+}
+
+func Test_cross_process_producer_and_consumer(t *testing.T) {
+	assert := NewAssert(t)
+	// both processes find the file missing
+	assert(ensureFileNotExist("/tmp/drbuffer_cross_process"), "==", nil)
+	processes := []*exec.Cmd{}
+	for _, role := range []string{"consumer", "producer"} {
+		process := exec.Command(os.Args[0], "-test.run=^Test_cross_process_helper$")
+		process.Env = append(os.Environ(), "DRBUFFER_TEST_ROLE="+role, "DRBUFFER_TEST_FILE=/tmp/drbuffer_cross_process")
+		process.Stderr = os.Stderr
+		assert(process.Start(), "==", nil)
+		processes = append(processes, process)
+	}
+	for _, process := range processes {
+		assert(process.Wait(), "==", nil)
+	}
+	buffer, err := Open("/tmp/drbuffer_cross_process", 4)
+	assert(err, "==", nil)
+	defer buffer.Close()
+	assert(buffer.RecoveryReport().Repaired(), "==", false)
+	assert(len(buffer.PopN(1)), "==", 0)
+}
+
+func Test_roles_limit_operations(t *testing.T) {
+	assert := NewAssert(t)
+	assert(ensureFileNotExist("/tmp/drbuffer_roles"), "==", nil)
+	_, err := Open("/tmp/drbuffer_roles", 1, WithRole(ProduceOnly))
+	assert(err, "!=", nil)
+	producer, err := Open("/tmp/drbuffer_roles", 1, WithRole(ProduceOnly), WithOverflowPolicy(RejectNewest))
+	assert(err, "==", nil)
+	defer producer.Close()
+	consumer, err := Open("/tmp/drbuffer_roles", 1, WithRole(ConsumeOnly))
+	assert(err, "==", nil)
+	defer consumer.Close()
+	assert(consumer.Push([]byte("A")), "==", ErrWrongRole)
+	assert(producer.Push([]byte("A")), "==", nil)
+	_, err = producer.PopNChecked(1)
+	assert(err, "==", ErrWrongRole)
+	_, err = consumer.Consumer("shipper")
+	assert(err, "==", ErrWrongRole)
+	assert(string(consumer.PopOne()), "==", "A")
+}
+
+// the reader sitting at wrapAt is not repelled across processes, the producer waits for it instead
+func Test_producer_does_not_move_reader_across_processes(t *testing.T) {
+	assert := NewAssert(t)
+	buffer := newBuffer(28)
+	buffer.sharedAcrossProcesses = true
+	buffer.overflowPolicy = RejectNewest
+	buffer.PushN([][]byte{
+		[]byte("AAAAAAAA"),
+		[]byte("BBBBBBBB"),
+	})
+	assert(len(buffer.PopN(2)), "==", 2)
+	buffer.Commit()
+	assert(buffer.Push([]byte("CCCCCCCC")), "==", nil)
+	assert(buffer.wrapAt.load(), "==", uint64(20))
+	assert(buffer.lastReadTo.load(), "==", uint64(20))
+	// would pass wrapAt, where the reader is
+	assert(buffer.Push([]byte("DDDDDDDD")), "==", ErrFull)
+	assert(buffer.lastReadTo.load(), "==", uint64(20))
+	assert(string(buffer.PopOne()), "==", "CCCCCCCC")
+	buffer.Commit()
+	assert(buffer.Push([]byte("DDDDDDDD")), "==", nil)
+	assert(string(buffer.PopOne()), "==", "DDDDDDDD")
+}
+
+func Test_read_only_role(t *testing.T) {
+	assert := NewAssert(t)
+	_, err := Open("/tmp/drbuffer_not_exist", 1, WithRole(ReadOnly))
+	assert(err, "!=", nil)
+	buffer := openNew(assert)
+	defer buffer.Close()
+	buffer.PushOne([]byte("A"))
+	// no lock taken, the file is held by the writer
+	reader, err := Open("/tmp/drbuffer", 1, WithRole(ReadOnly))
+	assert(err, "==", nil)
+	defer reader.Close()
+	assert(reader.Push([]byte("B")), "==", ErrWrongRole)
+	_, err = reader.PopNChecked(1)
+	assert(err, "==", ErrWrongRole)
+	assert(reader.RemoveConsumer("shipper"), "==", ErrWrongRole)
+	packets, err := reader.Peek(10)
+	assert(err, "==", nil)
+	assert(len(packets), "==", 1)
+	meta, err := ReadMeta("/tmp/drbuffer")
+	assert(err, "==", nil)
+	assert(meta.Version, "==", uint32(CURRENT_VERSION))
+	assert(meta.LastSequence, "==", uint64(1))
+	assert(meta.Stats.PendingPackets, "==", 1)
+}
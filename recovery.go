@@ -0,0 +1,203 @@
+package drbuffer
+
+import (
+	"errors"
+	"fmt"
+	"os"
+)
+
+// ErrCorruptedMeta is returned by Open for the roles not recovering the file, Repair fixes the pointers
+var ErrCorruptedMeta = errors.New("meta section is corrupted")
+
+// RecoveryReport describes what the recovery scan on Open found in the existing file
+type RecoveryReport struct {
+	PendingPackets int               // valid packets between lastReadTo and nextWriteFrom after recovery
+	TruncatedBytes uint64            // unreadable bytes dropped from the end of the pending region
+	Skipped        []CorruptionError // unreadable ranges followed by valid records, kept for PopN to skip
+	Repairs        []string          // one entry for every meta field changed
+}
+
+func (report RecoveryReport) Repaired() bool {
+	return len(report.Repairs) > 0
+}
+
+// recover walks the pending region from lastReadTo and moves the meta pointers back to the last consistent point.
+// nothing beyond nextWriteFrom is trusted: valid records there may be left over from an earlier lap.
+// since version 4 the shadow copy of last Flush replaces the pointers not consistent with the records first, see restoreShadow
+func (buffer *ringBuffer) recover() RecoveryReport {
+	report := RecoveryReport{}
+	buffer.restoreShadow(&report)
+	dataSize := uint64(len(buffer.data))
+	if buffer.nextWriteFrom.load() > dataSize {
+		report.repair("nextWriteFrom", buffer.nextWriteFrom, 0)
+		report.repair("lastReadTo", buffer.lastReadTo, 0)
+	}
+	if buffer.wrapAt.load() > dataSize {
+		report.repair("wrapAt", buffer.wrapAt, 0)
+	}
+	if buffer.lastReadTo.load() > dataSize ||
+		(buffer.lastReadTo.load() > buffer.nextWriteFrom.load() && buffer.wrapAt.load() < buffer.lastReadTo.load()) {
+		// the end of previous lap is unknown, only the current lap can be read
+		report.repair("lastReadTo", buffer.lastReadTo, 0)
+		report.repair("wrapAt", buffer.wrapAt, 0)
+	}
+	sequence := uint64(0) // of the last pending record kept
+	if buffer.lastReadTo.load() > buffer.nextWriteFrom.load() {
+		keptFrom, validTo := buffer.recoverRegion(buffer.lastReadTo.load(), buffer.wrapAt.load(), &sequence, &report)
+		report.repair("lastReadTo", buffer.lastReadTo, keptFrom)
+		if validTo != buffer.wrapAt.load() {
+			report.repair("wrapAt", buffer.wrapAt, validTo)
+		}
+		keptFrom, validTo = buffer.recoverRegion(0, buffer.nextWriteFrom.load(), &sequence, &report)
+		if keptFrom != 0 {
+			// the previous lap was written over as well
+			report.repair("lastReadTo", buffer.lastReadTo, keptFrom)
+			report.repair("wrapAt", buffer.wrapAt, 0)
+		}
+		if validTo != buffer.nextWriteFrom.load() {
+			report.repair("nextWriteFrom", buffer.nextWriteFrom, validTo)
+		}
+	} else {
+		keptFrom, validTo := buffer.recoverRegion(buffer.lastReadTo.load(), buffer.nextWriteFrom.load(), &sequence, &report)
+		report.repair("lastReadTo", buffer.lastReadTo, keptFrom)
+		if validTo != buffer.nextWriteFrom.load() {
+			report.repair("nextWriteFrom", buffer.nextWriteFrom, validTo)
+		}
+	}
+	for _, cursor := range buffer.cursors[1:] {
+		lastReadTo, nextWriteFrom, wrapAt := cursor.lastReadTo.load(), buffer.nextWriteFrom.load(), buffer.wrapAt.load()
+		if lastReadTo > dataSize || (lastReadTo > nextWriteFrom && lastReadTo > wrapAt) {
+			report.repair("consumer "+cursor.name+" lastReadTo", cursor.lastReadTo, 0)
+		} else if (lastReadTo > nextWriteFrom && !buffer.walksTo(lastReadTo, wrapAt)) ||
+			(lastReadTo <= nextWriteFrom && !buffer.walksTo(lastReadTo, nextWriteFrom)) {
+			// not at the start of a record, the default consumer is
+			report.repair("consumer "+cursor.name+" lastReadTo", cursor.lastReadTo, buffer.lastReadTo.load())
+		}
+	}
+	for _, cursor := range buffer.cursors {
+		cursor.nextReadFrom = cursor.lastReadTo.load()
+		cursor.pendingCounted = false
+	}
+	return report
+}
+
+// checkPointers fails for the pointers recover would move back into the data section
+func (buffer *ringBuffer) checkPointers() error {
+	dataSize := uint64(len(buffer.data))
+	nextWriteFrom, wrapAt := buffer.nextWriteFrom.load(), buffer.wrapAt.load()
+	if nextWriteFrom > dataSize {
+		return fmt.Errorf("%w: nextWriteFrom %d beyond data section of %d bytes", ErrCorruptedMeta, nextWriteFrom, dataSize)
+	}
+	if wrapAt > dataSize {
+		return fmt.Errorf("%w: wrapAt %d beyond data section of %d bytes", ErrCorruptedMeta, wrapAt, dataSize)
+	}
+	for _, cursor := range buffer.cursors {
+		name := "consumer " + cursor.name + " lastReadTo"
+		if cursor.name == "" {
+			name = "lastReadTo"
+		}
+		lastReadTo := cursor.lastReadTo.load()
+		if lastReadTo > dataSize {
+			return fmt.Errorf("%w: %s %d beyond data section of %d bytes", ErrCorruptedMeta, name, lastReadTo, dataSize)
+		}
+		if lastReadTo > nextWriteFrom && lastReadTo > wrapAt {
+			return fmt.Errorf("%w: %s %d after nextWriteFrom %d and wrapAt %d", ErrCorruptedMeta, name, lastReadTo, nextWriteFrom, wrapAt)
+		}
+	}
+	return nil
+}
+
+// recoverRegion returns where the records kept in [readFrom, readTo) start and end. the invalid records before the last
+// valid one are skipped up to the next valid one like PopN does, the invalid records after it are truncated.
+// since version 5 the pending records are numbered upwards from sequence: a commit not flushed yet lets the writer reuse
+// the space its lastReadTo still points to, so a record numbered lower than the one before it was pending before
+// the ones in front of it were written over the pending records, those are dropped
+func (buffer *ringBuffer) recoverRegion(readFrom, readTo uint64, sequence *uint64, report *RecoveryReport) (uint64, uint64) {
+	keptFrom, pos := readFrom, readFrom
+	highestSequence := uint64(0)
+	defer func() {
+		if buffer.format.sequenced && highestSequence > buffer.lastSequence.load() {
+			// the meta page was not written back, never hand out the sequence numbers already stored
+			report.repair("lastSequence", buffer.lastSequence, highestSequence)
+		}
+	}()
+	for pos < readTo {
+		_, recordSize, reason := buffer.format.read(buffer.data[pos:readTo])
+		if reason != "" {
+			nextValid := buffer.findNextValidRecord(pos+1, readTo)
+			if nextValid == readTo {
+				if IS_DEBUG {
+					fmt.Println("recovery truncated [", pos, ",", readTo, "):", reason)
+				}
+				report.TruncatedBytes += readTo - pos
+				return keptFrom, pos
+			}
+			report.Skipped = append(report.Skipped, CorruptionError{Offset: pos, Skipped: nextValid - pos, Reason: reason})
+			pos = nextValid
+			continue
+		}
+		recordSequence := buffer.format.sequence(buffer.data[pos:])
+		if buffer.format.sequenced && recordSequence <= *sequence {
+			keptFrom = pos
+			report.PendingPackets = 0
+			report.Skipped = nil
+		}
+		*sequence = recordSequence
+		highestSequence = max(highestSequence, recordSequence)
+		pos += recordSize
+		report.PendingPackets += 1
+	}
+	return keptFrom, pos
+}
+
+// walksTo tells if the records from readFrom end exactly at readTo
+func (buffer *ringBuffer) walksTo(readFrom, readTo uint64) bool {
+	for pos := readFrom; pos < readTo; {
+		_, recordSize, reason := buffer.format.read(buffer.data[pos:readTo])
+		if reason != "" {
+			return false
+		}
+		pos += recordSize
+	}
+	return true
+}
+
+func (report *RecoveryReport) repair(name string, field metaField, value uint64) {
+	if field.load() == value {
+		return
+	}
+	report.Repairs = append(report.Repairs, fmt.Sprintf("%s: %d -> %d", name, field.load(), value))
+	field.store(value)
+}
+
+// Verify walks the pending records like Open does, without locking or changing the file.
+// the report lists the anomalies as the repairs Repair would make
+func Verify(filePath string) (RecoveryReport, error) {
+	buffer, err := Open(filePath, 0, WithRole(ReadOnly), withUncheckedMeta())
+	if err != nil {
+		return RecoveryReport{}, err
+	}
+	defer buffer.Close()
+	durableBuffer := buffer.(*durableRingBuffer)
+	// recover a copy of the meta section, the data section is only read
+	meta := append([]byte(nil), durableBuffer.meta...)
+	return NewRingBuffer(meta, durableBuffer.data).recover(), nil
+}
+
+// Repair rewrites the meta section to the longest valid prefix of the pending records, and flushes it.
+// it fails like Verify for a missing file instead of creating it
+func Repair(filePath string) (RecoveryReport, error) {
+	if _, err := os.Stat(filePath); err != nil {
+		return RecoveryReport{}, err
+	}
+	buffer, err := Open(filePath, 0)
+	if err != nil {
+		return RecoveryReport{}, err
+	}
+	report := buffer.RecoveryReport()
+	if err = buffer.Flush(); err != nil {
+		buffer.Close()
+		return report, err
+	}
+	return report, buffer.Close()
+}
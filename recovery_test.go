@@ -0,0 +1,221 @@
+package drbuffer
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"os"
+	"testing"
+)
+
+func Test_recover_consistent_buffer(t *testing.T) {
+	assert := NewAssert(t)
+	buffer := newBufferOfVersion(2, 30)
+	buffer.PushN([][]byte{
+		[]byte("A"),
+		[]byte("B"),
+	})
+	report := buffer.recover()
+	assert(report.Repaired(), "==", false)
+	assert(report.PendingPackets, "==", 2)
+	assert(buffer.nextWriteFrom.load(), "==", uint64(14))
+}
+
+func Test_recover_meta_flushed_before_data(t *testing.T) {
+	assert := NewAssert(t)
+	buffer := newBufferOfVersion(2, 30)
+	buffer.PushN([][]byte{
+		[]byte("A"),
+		[]byte("B"),
+	})
+	copy(buffer.data[7:14], make([]byte, 7)) // "B" never reached the disk
+	report := buffer.recover()
+	assert(report.Repaired(), "==", true)
+	assert(report.PendingPackets, "==", 1)
+	assert(report.TruncatedBytes, "==", uint64(7))
+	assert(report.Repairs, "==", []string{"nextWriteFrom: 14 -> 7"})
+	assert(buffer.nextWriteFrom.load(), "==", uint64(7))
+	assert(len(buffer.PopN(1024)), "==", 1)
+}
+
+func Test_recover_skips_corrupted_record_in_the_middle(t *testing.T) {
+	assert := NewAssert(t)
+	buffer := newBufferOfVersion(2, 30)
+	buffer.PushN([][]byte{
+		[]byte("A"),
+		[]byte("B"),
+		[]byte("C"),
+	})
+	buffer.data[13] = 'b' // corrupt "B"
+	report := buffer.recover()
+	assert(report.Repaired(), "==", false)
+	assert(report.TruncatedBytes, "==", uint64(0))
+	assert(report.Skipped, "==", []CorruptionError{{Offset: 7, Skipped: 7, Reason: "checksum mismatch"}})
+	assert(report.PendingPackets, "==", 2)
+	assert(buffer.nextWriteFrom.load(), "==", uint64(21))
+	assert(buffer.PopN(1024), "==", [][]byte{[]byte("A")})
+	assert(buffer.PopN(1024), "==", [][]byte{[]byte("C")})
+}
+
+func Test_recover_previous_lap(t *testing.T) {
+	assert := NewAssert(t)
+	buffer := newBufferOfVersion(2, 30)
+	buffer.PushN([][]byte{
+		[]byte("AAAAAA"),
+		[]byte("BBBBBB"),
+	})
+	buffer.PopN(1)
+	buffer.PopN(1)
+	buffer.PushOne([]byte("CC"))
+	assert(buffer.lastReadTo.load(), "==", uint64(12))
+	assert(buffer.wrapAt.load(), "==", uint64(24))
+	buffer.data[20] = 0 // corrupt "B" in the previous lap
+	report := buffer.recover()
+	assert(report.Repairs, "==", []string{"wrapAt: 24 -> 12"})
+	assert(report.PendingPackets, "==", 1)
+	packets := buffer.PopN(1024)
+	assert(len(packets), "==", 1)
+	assert(string(packets[0]), "==", "CC")
+}
+
+func Test_recover_pointers_out_of_range(t *testing.T) {
+	assert := NewAssert(t)
+	buffer := newBufferOfVersion(2, 30)
+	buffer.PushOne([]byte("A"))
+	buffer.lastReadTo.store(100)
+	report := buffer.recover()
+	assert(report.Repairs, "==", []string{"lastReadTo: 100 -> 0"})
+	assert(string(buffer.PopOne()), "==", "A")
+}
+
+func Test_recover_consumer_out_of_range(t *testing.T) {
+	assert := NewAssert(t)
+	buffer := newBufferOfVersion(4, 30)
+	shipper, _ := buffer.consumer("shipper")
+	buffer.PushOne([]byte("A"))
+	shipper.lastReadTo.store(20)
+	report := buffer.recover()
+	assert(report.Repairs, "==", []string{"consumer shipper lastReadTo: 20 -> 0"})
+	assert(string(shipper.PopOne()), "==", "A")
+}
+
+func Test_recover_consumer_not_at_record_start(t *testing.T) {
+	assert := NewAssert(t)
+	buffer := newBufferOfVersion(4, 60)
+	shipper, _ := buffer.consumer("shipper")
+	buffer.PushN([][]byte{
+		[]byte("A"),
+		[]byte("B"),
+	})
+	assert(string(buffer.PopOne()), "==", "A")
+	buffer.Commit()
+	shipper.lastReadTo.store(3)
+	report := buffer.recover()
+	assert(report.Repairs, "==", []string{"consumer shipper lastReadTo: 3 -> 9"})
+	assert(shipper.PopN(10), "==", [][]byte{[]byte("B")})
+}
+
+func Test_verify_consumer_not_at_record_start(t *testing.T) {
+	assert := NewAssert(t)
+	buffer := openNew(assert)
+	_, err := buffer.Consumer("shipper")
+	assert(err, "==", nil)
+	buffer.PushOne([]byte("Hello"))
+	assert(buffer.Close(), "==", nil)
+	file, err := os.OpenFile("/tmp/drbuffer", os.O_RDWR, 0644)
+	assert(err, "==", nil)
+	_, err = file.WriteAt([]byte{3}, CONSUMER_TABLE_OFFSET+MAX_CONSUMER_NAME_SIZE)
+	assert(err, "==", nil)
+	assert(file.Close(), "==", nil)
+	report, err := Verify("/tmp/drbuffer")
+	assert(err, "==", nil)
+	assert(report.Repairs, "==", []string{"consumer shipper lastReadTo: 3 -> 0"})
+}
+
+func Test_recover_last_sequence(t *testing.T) {
+	assert := NewAssert(t)
+	buffer := newBufferOfVersion(5, 60)
+	buffer.PushN([][]byte{
+		[]byte("A"),
+		[]byte("B"),
+	})
+	buffer.lastSequence.store(1) // the meta page was written back before "B"
+	report := buffer.recover()
+	assert(report.Repairs, "==", []string{"lastSequence: 1 -> 2"})
+	sequence, _ := buffer.PushWithSequence([]byte("C"))
+	assert(sequence, "==", uint64(3))
+}
+
+func Test_verify_and_repair_file(t *testing.T) {
+	assert := NewAssert(t)
+	buffer := openNew(assert)
+	buffer.PushN([][]byte{
+		[]byte("Hello"),
+		[]byte("World"),
+	})
+	recordSize := buffer.(*durableRingBuffer).format.headerSize() + 5
+	assert(buffer.Close(), "==", nil)
+	report, err := Verify("/tmp/drbuffer")
+	assert(err, "==", nil)
+	assert(report.Repaired(), "==", false)
+	assert(report.PendingPackets, "==", 2)
+	file, err := os.OpenFile("/tmp/drbuffer", os.O_RDWR, 0644)
+	assert(err, "==", nil)
+	_, err = file.WriteAt([]byte("w"), int64(WIDE_META_SECTION_SIZE+recordSize*2-5)) // "World" corrupted
+	assert(err, "==", nil)
+	assert(file.Close(), "==", nil)
+	expectedRepairs := []string{fmt.Sprintf("nextWriteFrom: %d -> %d", recordSize*2, recordSize)}
+	for i := 0; i < 2; i++ {
+		// the file is not changed by Verify
+		report, err = Verify("/tmp/drbuffer")
+		assert(err, "==", nil)
+		assert(report.Repairs, "==", expectedRepairs)
+		assert(report.TruncatedBytes, "==", recordSize)
+	}
+	report, err = Repair("/tmp/drbuffer")
+	assert(err, "==", nil)
+	assert(report.Repairs, "==", expectedRepairs)
+	report, err = Verify("/tmp/drbuffer")
+	assert(err, "==", nil)
+	assert(report.Repaired(), "==", false)
+	assert(report.PendingPackets, "==", 1)
+}
+
+func Test_repair_missing_file(t *testing.T) {
+	assert := NewAssert(t)
+	assert(ensureFileNotExist("/tmp/drbuffer"), "==", nil)
+	_, err := Repair("/tmp/drbuffer")
+	assert(errors.Is(err, os.ErrNotExist), "==", true)
+	_, err = os.Stat("/tmp/drbuffer")
+	assert(os.IsNotExist(err), "==", true)
+}
+
+func Test_roles_not_recovering_reject_pointers_out_of_range(t *testing.T) {
+	assert := NewAssert(t)
+	buffer := openNew(assert)
+	_, err := buffer.Consumer("shipper")
+	assert(err, "==", nil)
+	buffer.PushOne([]byte("Hello"))
+	assert(buffer.Close(), "==", nil)
+	file, err := os.OpenFile("/tmp/drbuffer", os.O_RDWR, 0644)
+	assert(err, "==", nil)
+	consumerLastReadTo := make([]byte, 8)
+	binary.LittleEndian.PutUint64(consumerLastReadTo, 5000)
+	_, err = file.WriteAt(consumerLastReadTo, CONSUMER_TABLE_OFFSET+MAX_CONSUMER_NAME_SIZE)
+	assert(err, "==", nil)
+	assert(file.Close(), "==", nil)
+	for _, role := range []Role{ReadOnly, ConsumeOnly} {
+		_, err = Open("/tmp/drbuffer", 1, WithRole(role))
+		assert(errors.Is(err, ErrCorruptedMeta), "==", true)
+		assert(err.Error(), "==", "meta section is corrupted: consumer shipper lastReadTo 5000 beyond data section of 1024 bytes")
+	}
+	_, err = ReadMeta("/tmp/drbuffer")
+	assert(errors.Is(err, ErrCorruptedMeta), "==", true)
+	// the producer recovers the file
+	buffer, err = Open("/tmp/drbuffer", 2, WithAutoGrow())
+	assert(err, "==", nil)
+	defer buffer.Close()
+	shipper, err := buffer.Consumer("shipper")
+	assert(err, "==", nil)
+	assert(string(shipper.PopOne()), "==", "Hello")
+}
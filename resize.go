@@ -0,0 +1,126 @@
+package drbuffer
+
+import (
+	"fmt"
+	"math"
+	"os"
+	"path/filepath"
+)
+
+// Resize rewrites the file with nkiloBytes for packets, growing or shrinking it.
+// the packets not committed by every consumer are moved to the start of the data section in order,
+// it fails if they do not fit. the new file replaces the old one once complete, so a crash leaves the old one intact.
+// an Open waiting for the lock meanwhile finds the file replaced and opens the new one
+func Resize(filePath string, nkiloBytes int) error {
+	if err := checkKiloBytes(nkiloBytes); err != nil {
+		return err
+	}
+	buffer, err := Open(filePath, 0)
+	if err != nil {
+		return err
+	}
+	defer buffer.Close()
+	durableBuffer := buffer.(*durableRingBuffer)
+	durableBuffer.lock.Lock()
+	defer durableBuffer.lock.Unlock()
+	return durableBuffer.rewriteTo(filePath, uint64(nkiloBytes)*1024)
+}
+
+// growIfSmaller resizes the existing file to nkiloBytes if it has less room for packets
+func growIfSmaller(filePath string, nkiloBytes int) error {
+	if err := checkKiloBytes(nkiloBytes); err != nil {
+		return err
+	}
+	if _, err := os.Stat(filePath); os.IsNotExist(err) {
+		return nil
+	}
+	// the pointers are recovered by Resize, the size is enough here
+	buffer, err := Open(filePath, 0, WithRole(ReadOnly), withUncheckedMeta())
+	if err != nil {
+		return err
+	}
+	dataSize := uint64(len(buffer.(*durableRingBuffer).data))
+	buffer.Close()
+	if dataSize >= uint64(nkiloBytes)*1024 {
+		return nil
+	}
+	return Resize(filePath, nkiloBytes)
+}
+
+// rewriteTo expects the lock held
+func (buffer *durableRingBuffer) rewriteTo(filePath string, dataSize uint64) error {
+	if *buffer.version < FIRST_WIDE_VERSION && dataSize > math.MaxUint32 {
+		return fmt.Errorf("data section of %d bytes does not fit in the meta section of version %d", dataSize, *buffer.version)
+	}
+	backlog, newPosition := buffer.linearize(buffer.oldestReadTo())
+	if uint64(len(backlog)) > dataSize {
+		return fmt.Errorf("%d bytes of packets not committed do not fit in %d bytes", len(backlog), dataSize)
+	}
+	meta := append([]byte(nil), buffer.meta...)
+	resized := NewRingBuffer(meta, nil)
+	for i, cursor := range resized.cursors {
+		cursor.lastReadTo.store(newPosition(buffer.cursors[i].lastReadTo.load()))
+	}
+	resized.nextWriteFrom.store(uint64(len(backlog)))
+	resized.wrapAt.store(0)
+	resized.writeShadow()
+	resized.dropOlderShadow()
+	tmpPath := filePath + ".resizing"
+	if err := writeResizedFile(tmpPath, meta, backlog, dataSize); err != nil {
+		os.Remove(tmpPath)
+		return err
+	}
+	if err := os.Rename(tmpPath, filePath); err != nil {
+		os.Remove(tmpPath)
+		return annotatedError{err, "failed to replace file"}
+	}
+	dir, err := os.Open(filepath.Dir(filePath))
+	if err != nil {
+		return annotatedError{err, "failed to open directory"}
+	}
+	defer dir.Close()
+	return dir.Sync()
+}
+
+func writeResizedFile(filePath string, meta []byte, backlog []byte, dataSize uint64) error {
+	fileObj, err := os.OpenFile(filePath, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return annotatedError{err, "failed to create new file"}
+	}
+	defer fileObj.Close()
+	if _, err = fileObj.Write(meta); err != nil {
+		return annotatedError{err, "failed to write meta section"}
+	}
+	if _, err = fileObj.Write(backlog); err != nil {
+		return annotatedError{err, "failed to write packets"}
+	}
+	if err = writeZeros(fileObj, dataSize-uint64(len(backlog))); err != nil {
+		return err
+	}
+	if err = fileObj.Sync(); err != nil {
+		return annotatedError{err, "failed to sync new file"}
+	}
+	return nil
+}
+
+// linearize copies the records from readFrom to nextWriteFrom in order,
+// newPosition maps a position in that range to the offset in the copy
+func (buffer *ringBuffer) linearize(readFrom uint64) (backlog []byte, newPosition func(uint64) uint64) {
+	nextWriteFrom := buffer.nextWriteFrom.load()
+	if readFrom <= nextWriteFrom {
+		backlog = append([]byte(nil), buffer.data[readFrom:nextWriteFrom]...)
+		return backlog, func(pos uint64) uint64 {
+			return pos - readFrom
+		}
+	}
+	// the previous lap from readFrom to wrapAt comes first
+	wrapAt := buffer.wrapAt.load()
+	backlog = append([]byte(nil), buffer.data[readFrom:wrapAt]...)
+	backlog = append(backlog, buffer.data[:nextWriteFrom]...)
+	return backlog, func(pos uint64) uint64 {
+		if pos >= readFrom {
+			return pos - readFrom
+		}
+		return wrapAt - readFrom + pos
+	}
+}
@@ -0,0 +1,131 @@
+package drbuffer
+
+import (
+	"fmt"
+	"os"
+	"testing"
+	"time"
+)
+
+func Test_resize_linearizes_pending_packets(t *testing.T) {
+	assert := NewAssert(t)
+	buffer := openNew(assert)
+	shipper, err := buffer.Consumer("shipper")
+	assert(err, "==", nil)
+	for i := 0; i < 4; i++ {
+		buffer.PushOne([]byte(fmt.Sprintf("%d%s", i, make([]byte, 199))))
+	}
+	assert(len(buffer.PopN(2)), "==", 2)
+	assert(buffer.Commit(), "==", nil)
+	assert(len(shipper.PopN(3)), "==", 3)
+	assert(shipper.Commit(), "==", nil)
+	buffer.PushOne([]byte(fmt.Sprintf("%d%s", 4, make([]byte, 199))))
+	// 2 and 3 at the end of previous lap, 4 at the start
+	assert(buffer.(*durableRingBuffer).wrapAt.load(), "!=", uint64(0))
+	assert(buffer.Close(), "==", nil)
+	for _, nkiloBytes := range []int{4, 1} {
+		assert(Resize("/tmp/drbuffer", nkiloBytes), "==", nil)
+		buffer, err = Open("/tmp/drbuffer", 1)
+		assert(err, "==", nil)
+		assert(buffer.RecoveryReport().Repaired(), "==", false)
+		assert(buffer.Stats().Capacity, "==", uint64(nkiloBytes*1024))
+		meta := buffer.(*durableRingBuffer).snapshotMeta()
+		assert(meta.WrapAt, "==", uint64(0))
+		assert(meta.LastReadTo, "==", uint64(0))
+		assert(meta.Consumers[0].LastReadTo, "==", meta.NextWriteFrom/3)
+		packets, err := buffer.Peek(10)
+		assert(err, "==", nil)
+		assert(len(packets), "==", 3)
+		assert(packets[0][0], "==", byte('2'))
+		assert(packets[2][0], "==", byte('4'))
+		shipper, err = buffer.Consumer("shipper")
+		assert(err, "==", nil)
+		packets, err = shipper.Peek(10)
+		assert(len(packets), "==", 2)
+		assert(packets[0][0], "==", byte('3'))
+		assert(buffer.Close(), "==", nil)
+	}
+}
+
+func Test_resize_fails_when_backlog_does_not_fit(t *testing.T) {
+	assert := NewAssert(t)
+	assert(ensureFileNotExist("/tmp/drbuffer"), "==", nil)
+	buffer, err := Open("/tmp/drbuffer", 2)
+	assert(err, "==", nil)
+	buffer.PushOne(make([]byte, 1500))
+	assert(buffer.Close(), "==", nil)
+	assert(Resize("/tmp/drbuffer", 1), "!=", nil)
+	buffer, err = Open("/tmp/drbuffer", 1)
+	assert(err, "==", nil)
+	defer buffer.Close()
+	assert(buffer.Stats().Capacity, "==", uint64(2048))
+	assert(len(buffer.PopN(1)[0]), "==", 1500)
+}
+
+func Test_auto_grow(t *testing.T) {
+	assert := NewAssert(t)
+	buffer := openNew(assert)
+	buffer.PushOne([]byte("Hello"))
+	assert(buffer.Close(), "==", nil)
+	buffer, err := Open("/tmp/drbuffer", 2)
+	assert(err, "==", nil)
+	assert(buffer.Stats().Capacity, "==", uint64(1024))
+	assert(buffer.Close(), "==", nil)
+	buffer, err = Open("/tmp/drbuffer", 2, WithAutoGrow())
+	assert(err, "==", nil)
+	defer buffer.Close()
+	assert(buffer.Stats().Capacity, "==", uint64(2048))
+	assert(string(buffer.PopOne()), "==", "Hello")
+}
+
+func Test_open_waiting_for_lock_during_resize_opens_new_file(t *testing.T) {
+	assert := NewAssert(t)
+	buffer := openNew(assert)
+	buffer.PushOne([]byte("Hello"))
+	type opened struct {
+		buffer DurableRingBuffer
+		err    error
+	}
+	waiter := make(chan opened, 1)
+	go func() {
+		buffer, err := Open("/tmp/drbuffer", 1, WithLockTimeout(5*time.Second))
+		waiter <- opened{buffer, err}
+	}()
+	time.Sleep(50 * time.Millisecond)
+	// replaced like Resize does, while the waiter is waiting for the lock of the old file
+	durableBuffer := buffer.(*durableRingBuffer)
+	durableBuffer.lock.Lock()
+	assert(durableBuffer.rewriteTo("/tmp/drbuffer", 2048), "==", nil)
+	durableBuffer.lock.Unlock()
+	assert(buffer.Close(), "==", nil)
+	result := <-waiter
+	assert(result.err, "==", nil)
+	defer result.buffer.Close()
+	assert(result.buffer.Stats().Capacity, "==", uint64(2048))
+	assert(string(result.buffer.PopOne()), "==", "Hello")
+	result.buffer.PushOne([]byte("World"))
+	assert(result.buffer.Flush(), "==", nil)
+	meta, err := ReadMeta("/tmp/drbuffer")
+	assert(err, "==", nil)
+	assert(meta.DataSize, "==", uint64(2048))
+	assert(meta.LastSequence, "==", uint64(2))
+}
+
+func Test_negative_size_rejected(t *testing.T) {
+	assert := NewAssert(t)
+	assert(ensureFileNotExist("/tmp/drbuffer"), "==", nil)
+	_, err := Open("/tmp/drbuffer", -5)
+	assert(err, "!=", nil)
+	_, err = os.Stat("/tmp/drbuffer")
+	assert(os.IsNotExist(err), "==", true)
+	buffer := openNew(assert)
+	assert(buffer.Close(), "==", nil)
+	assert(Resize("/tmp/drbuffer", -1), "!=", nil)
+	assert(growIfSmaller("/tmp/drbuffer", -1), "!=", nil)
+	_, err = Open("/tmp/drbuffer", -1, WithAutoGrow())
+	assert(err, "!=", nil)
+	buffer, err = Open("/tmp/drbuffer", 1)
+	assert(err, "==", nil)
+	defer buffer.Close()
+	assert(buffer.Stats().Capacity, "==", uint64(1024))
+}
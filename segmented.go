@@ -0,0 +1,421 @@
+package drbuffer
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+const SEGMENT_FILE_SUFFIX = ".seg"
+
+// SegmentedQueue chains ring files in a directory, the last segment is pushed into and
+// a new one is created when it is full, so nothing is overwritten.
+// a segment file is deleted once every consumer has committed all its packets
+type SegmentedQueue struct {
+	*SegmentConsumer // the default consumer
+	lock             sync.Mutex
+	dir              string
+	nkiloBytes       int
+	optionList       []Option
+	segments         []*segment
+	consumers        map[string]*SegmentConsumer // the named consumers
+	closed           bool
+}
+
+type segment struct {
+	id     uint64
+	buffer DurableRingBuffer
+}
+
+// SegmentConsumer reads the queue segment by segment
+type SegmentConsumer struct {
+	queue     *SegmentedQueue
+	name      string
+	segmentID uint64 // the segment being read, the ones before are passed
+	removed   bool
+}
+
+// OpenSegmented opens the segments in the directory, every new segment has nkiloBytes for packets.
+// the options apply to every segment, except the overflow policy which is always RejectNewest
+func OpenSegmented(dir string, nkiloBytes int, optionList ...Option) (*SegmentedQueue, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, annotatedError{err, "failed to create directory"}
+	}
+	queue := &SegmentedQueue{
+		dir:        dir,
+		nkiloBytes: nkiloBytes,
+		optionList: append(append([]Option(nil), optionList...), WithOverflowPolicy(RejectNewest)),
+		consumers:  map[string]*SegmentConsumer{},
+	}
+	queue.SegmentConsumer = &SegmentConsumer{queue: queue}
+	ids, err := listSegments(dir)
+	if err != nil {
+		return nil, err
+	}
+	for _, id := range ids {
+		buffer, err := Open(queue.segmentPath(id), nkiloBytes, queue.optionList...)
+		if err != nil {
+			queue.closeSegments()
+			return nil, annotatedError{err, fmt.Sprintf("failed to open segment %d", id)}
+		}
+		queue.segments = append(queue.segments, &segment{id, buffer})
+	}
+	if len(queue.segments) == 0 {
+		if err := queue.roll(); err != nil {
+			return nil, err
+		}
+	}
+	// every consumer is registered in the active segment, the older ones may list the consumers removed since
+	for _, consumerMeta := range queue.active().buffer.(*durableRingBuffer).snapshotMeta().Consumers {
+		queue.consumers[consumerMeta.Name] = &SegmentConsumer{queue: queue, name: consumerMeta.Name}
+	}
+	for _, consumer := range queue.allConsumers() {
+		consumer.segmentID = queue.firstPendingSegment(consumer)
+	}
+	if err := queue.deletePassedSegments(); err != nil {
+		queue.closeSegments()
+		return nil, err
+	}
+	return queue, nil
+}
+
+func listSegments(dir string) ([]uint64, error) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, annotatedError{err, "failed to list directory"}
+	}
+	ids := []uint64{}
+	for _, entry := range entries {
+		if !strings.HasSuffix(entry.Name(), SEGMENT_FILE_SUFFIX) {
+			continue
+		}
+		id, err := strconv.ParseUint(strings.TrimSuffix(entry.Name(), SEGMENT_FILE_SUFFIX), 10, 64)
+		if err != nil {
+			continue
+		}
+		ids = append(ids, id)
+	}
+	sort.Slice(ids, func(i, j int) bool { return ids[i] < ids[j] })
+	return ids, nil
+}
+
+func (queue *SegmentedQueue) segmentPath(id uint64) string {
+	return filepath.Join(queue.dir, fmt.Sprintf("%020d%s", id, SEGMENT_FILE_SUFFIX))
+}
+
+func (queue *SegmentedQueue) active() *segment {
+	return queue.segments[len(queue.segments)-1]
+}
+
+func (queue *SegmentedQueue) segment(id uint64) *segment {
+	for _, segment := range queue.segments {
+		if segment.id == id {
+			return segment
+		}
+	}
+	return nil
+}
+
+func (segment *segment) registers(name string) bool {
+	for _, consumerMeta := range segment.buffer.(*durableRingBuffer).snapshotMeta().Consumers {
+		if consumerMeta.Name == name {
+			return true
+		}
+	}
+	return false
+}
+
+func (queue *SegmentedQueue) allConsumers() []*SegmentConsumer {
+	consumers := []*SegmentConsumer{queue.SegmentConsumer}
+	for _, consumer := range queue.consumers {
+		consumers = append(consumers, consumer)
+	}
+	return consumers
+}
+
+// roll creates the next segment with the named consumers registered, sequence numbers go on from the last segment
+func (queue *SegmentedQueue) roll() error {
+	id := uint64(1)
+	lastSequence := uint64(0)
+	if len(queue.segments) > 0 {
+		id = queue.active().id + 1
+		lastSequence = queue.active().buffer.(*durableRingBuffer).lastSequence.load()
+	}
+	buffer, err := Open(queue.segmentPath(id), queue.nkiloBytes, queue.optionList...)
+	if err != nil {
+		return annotatedError{err, fmt.Sprintf("failed to create segment %d", id)}
+	}
+	if ring := buffer.(*durableRingBuffer); ring.format.sequenced {
+		ring.lastSequence.store(lastSequence)
+	}
+	for name := range queue.consumers {
+		if _, err := buffer.Consumer(name); err != nil {
+			buffer.Close()
+			os.Remove(queue.segmentPath(id))
+			return err
+		}
+	}
+	queue.segments = append(queue.segments, &segment{id, buffer})
+	return nil
+}
+
+// firstPendingSegment is where the consumer has packets not committed, or the active segment
+func (queue *SegmentedQueue) firstPendingSegment(consumer *SegmentConsumer) uint64 {
+	for _, segment := range queue.segments[:len(queue.segments)-1] {
+		reader, err := consumer.of(segment)
+		if err != nil {
+			// not registered when the segment was read, so it is passed
+			continue
+		}
+		if packets, _ := reader.Peek(1); len(packets) > 0 {
+			return segment.id
+		}
+	}
+	return queue.active().id
+}
+
+// deletePassedSegments removes the segments every consumer has passed, the active one is kept
+func (queue *SegmentedQueue) deletePassedSegments() error {
+	for len(queue.segments) > 1 {
+		first := queue.segments[0]
+		for _, consumer := range queue.allConsumers() {
+			if consumer.segmentID <= first.id {
+				return nil
+			}
+		}
+		if err := first.buffer.Close(); err != nil {
+			return err
+		}
+		if err := os.Remove(queue.segmentPath(first.id)); err != nil {
+			return annotatedError{err, "failed to delete segment"}
+		}
+		queue.segments = queue.segments[1:]
+	}
+	return nil
+}
+
+func (queue *SegmentedQueue) closeSegments() error {
+	var firstErr error
+	for _, segment := range queue.segments {
+		if err := segment.buffer.Close(); err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	return firstErr
+}
+
+// Segments counts the segment files
+func (queue *SegmentedQueue) Segments() int {
+	queue.lock.Lock()
+	defer queue.lock.Unlock()
+	return len(queue.segments)
+}
+
+func (queue *SegmentedQueue) PushOne(p []byte) {
+	if err := queue.Push(p); err != nil {
+		panic(err.Error())
+	}
+}
+
+func (queue *SegmentedQueue) PushN(pList [][]byte) {
+	if _, err := queue.PushBatch(pList); err != nil {
+		panic(err.Error())
+	}
+}
+
+// Push rolls to a new segment when the active one is full
+func (queue *SegmentedQueue) Push(p []byte) error {
+	_, err := queue.PushWithSequence(p)
+	return err
+}
+
+// PushWithSequence is Push returning the sequence number of the packet, it goes on across segments
+func (queue *SegmentedQueue) PushWithSequence(p []byte) (uint64, error) {
+	queue.lock.Lock()
+	defer queue.lock.Unlock()
+	return queue.push(p)
+}
+
+func (queue *SegmentedQueue) PushBatch(pList [][]byte) (int, error) {
+	queue.lock.Lock()
+	defer queue.lock.Unlock()
+	for i, p := range pList {
+		if _, err := queue.push(p); err != nil {
+			return i, err
+		}
+	}
+	return len(pList), nil
+}
+
+func (queue *SegmentedQueue) push(p []byte) (uint64, error) {
+	if queue.closed {
+		return 0, ErrClosed
+	}
+	sequence, err := queue.active().buffer.PushWithSequence(p)
+	if err != ErrFull {
+		return sequence, err
+	}
+	if err = queue.roll(); err != nil {
+		return 0, err
+	}
+	return queue.active().buffer.PushWithSequence(p)
+}
+
+// Consumer returns the named consumer, registers it if not found starting from the default consumer
+func (queue *SegmentedQueue) Consumer(name string) (*SegmentConsumer, error) {
+	queue.lock.Lock()
+	defer queue.lock.Unlock()
+	if queue.closed {
+		return nil, ErrClosed
+	}
+	if consumer := queue.consumers[name]; consumer != nil {
+		return consumer, nil
+	}
+	for _, segment := range queue.segments {
+		if segment.id < queue.segmentID {
+			continue
+		}
+		if _, err := segment.buffer.Consumer(name); err != nil {
+			return nil, err
+		}
+	}
+	consumer := &SegmentConsumer{queue: queue, name: name, segmentID: queue.segmentID}
+	queue.consumers[name] = consumer
+	return consumer, nil
+}
+
+func (queue *SegmentedQueue) RemoveConsumer(name string) error {
+	queue.lock.Lock()
+	defer queue.lock.Unlock()
+	if queue.closed {
+		return ErrClosed
+	}
+	consumer := queue.consumers[name]
+	if consumer == nil {
+		return fmt.Errorf("consumer not found: %q", name)
+	}
+	// the passed segments kept for other consumers list it too, the active one goes first as it decides on open
+	for i := len(queue.segments) - 1; i >= 0; i-- {
+		if !queue.segments[i].registers(name) {
+			continue
+		}
+		if err := queue.segments[i].buffer.RemoveConsumer(name); err != nil {
+			return err
+		}
+	}
+	consumer.removed = true
+	delete(queue.consumers, name)
+	return queue.deletePassedSegments()
+}
+
+func (queue *SegmentedQueue) Flush() error {
+	queue.lock.Lock()
+	defer queue.lock.Unlock()
+	if queue.closed {
+		return ErrClosed
+	}
+	for _, segment := range queue.segments {
+		if err := segment.buffer.Flush(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (queue *SegmentedQueue) Close() error {
+	queue.lock.Lock()
+	defer queue.lock.Unlock()
+	if queue.closed {
+		return ErrClosed
+	}
+	queue.closed = true
+	return queue.closeSegments()
+}
+
+// of is the consumer of the segment, it fails for a named consumer not registered there
+func (consumer *SegmentConsumer) of(segment *segment) (Consumer, error) {
+	if consumer.name == "" {
+		return segment.buffer, nil
+	}
+	for _, consumerMeta := range segment.buffer.(*durableRingBuffer).snapshotMeta().Consumers {
+		if consumerMeta.Name == consumer.name {
+			return segment.buffer.Consumer(consumer.name)
+		}
+	}
+	return nil, fmt.Errorf("consumer not found: %q", consumer.name)
+}
+
+func (consumer *SegmentConsumer) checkUsable() error {
+	if consumer.queue.closed {
+		return ErrClosed
+	}
+	if consumer.removed {
+		return ErrConsumerRemoved
+	}
+	return nil
+}
+
+func (consumer *SegmentConsumer) PopOne() []byte {
+	packets := consumer.PopN(1)
+	if len(packets) > 0 {
+		return packets[0]
+	} else {
+		return nil
+	}
+}
+
+func (consumer *SegmentConsumer) PopN(maxPacketsCount int) [][]byte {
+	packets, _ := consumer.PopNChecked(maxPacketsCount)
+	return packets
+}
+
+// PopNChecked commits the packets of last pop, and moves on to the next segment once the current one is drained.
+// packets of one pop come from a single segment
+func (consumer *SegmentConsumer) PopNChecked(maxPacketsCount int) ([][]byte, error) {
+	queue := consumer.queue
+	queue.lock.Lock()
+	defer queue.lock.Unlock()
+	if err := consumer.checkUsable(); err != nil {
+		return nil, err
+	}
+	for {
+		segment := queue.segment(consumer.segmentID)
+		reader, err := consumer.of(segment)
+		if err != nil {
+			return nil, err
+		}
+		packets, err := reader.PopNChecked(maxPacketsCount)
+		if len(packets) > 0 || err != nil || segment == queue.active() {
+			return packets, err
+		}
+		// everything popped from the segment is committed by the pop above, the next segment is the one after
+		for _, next := range queue.segments {
+			if next.id > segment.id {
+				consumer.segmentID = next.id
+				break
+			}
+		}
+		if err := queue.deletePassedSegments(); err != nil {
+			return nil, err
+		}
+	}
+}
+
+// Commit marks every popped packet consumed
+func (consumer *SegmentConsumer) Commit() error {
+	queue := consumer.queue
+	queue.lock.Lock()
+	defer queue.lock.Unlock()
+	if err := consumer.checkUsable(); err != nil {
+		return err
+	}
+	reader, err := consumer.of(queue.segment(consumer.segmentID))
+	if err != nil {
+		return err
+	}
+	return reader.Commit()
+}
@@ -0,0 +1,120 @@
+package drbuffer
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"testing"
+)
+
+func openNewSegmented(assert Assert) *SegmentedQueue {
+	os.RemoveAll("/tmp/drbuffer-segments")
+	queue, err := OpenSegmented("/tmp/drbuffer-segments", 1)
+	assert(err, "==", nil)
+	return queue
+}
+
+func Test_segmented_rolls_and_deletes_passed_segments(t *testing.T) {
+	assert := NewAssert(t)
+	queue := openNewSegmented(assert)
+	defer queue.Close()
+	for i := 0; i < 12; i++ {
+		sequence, err := queue.PushWithSequence([]byte(fmt.Sprintf("%d%s", i%10, make([]byte, 199))))
+		assert(err, "==", nil)
+		assert(sequence, "==", uint64(i+1))
+	}
+	// 4 packets of 215 bytes fit in one segment
+	assert(queue.Segments(), "==", 3)
+	for i := 0; i < 12; i++ {
+		packet := queue.PopOne()
+		assert(len(packet), "==", 200)
+		assert(packet[0], "==", byte('0'+i%10))
+	}
+	assert(queue.PopOne() == nil, "==", true)
+	assert(queue.Segments(), "==", 1)
+	files, err := listSegments("/tmp/drbuffer-segments")
+	assert(err, "==", nil)
+	assert(files, "==", []uint64{3})
+}
+
+func Test_segmented_keeps_segments_for_named_consumer(t *testing.T) {
+	assert := NewAssert(t)
+	queue := openNewSegmented(assert)
+	shipper, err := queue.Consumer("shipper")
+	assert(err, "==", nil)
+	for i := 0; i < 8; i++ {
+		queue.PushOne(make([]byte, 200))
+	}
+	assert(queue.Segments(), "==", 2)
+	assert(len(queue.PopN(10)), "==", 4)
+	assert(len(queue.PopN(10)), "==", 4)
+	assert(queue.Segments(), "==", 2)
+	assert(len(shipper.PopN(3)), "==", 3)
+	assert(shipper.Commit(), "==", nil)
+	assert(queue.Close(), "==", nil)
+
+	queue, err = OpenSegmented("/tmp/drbuffer-segments", 1)
+	assert(err, "==", nil)
+	defer queue.Close()
+	assert(queue.Segments(), "==", 2)
+	shipper, err = queue.Consumer("shipper")
+	assert(err, "==", nil)
+	assert(len(shipper.PopN(10)), "==", 1)
+	assert(len(shipper.PopN(10)), "==", 4)
+	assert(queue.Segments(), "==", 1)
+	// sequence numbers go on after reopen
+	sequence, err := queue.PushWithSequence(make([]byte, 200))
+	assert(err, "==", nil)
+	assert(sequence, "==", uint64(9))
+}
+
+func Test_segmented_remove_consumer_deletes_segments(t *testing.T) {
+	assert := NewAssert(t)
+	queue := openNewSegmented(assert)
+	defer queue.Close()
+	_, err := queue.Consumer("shipper")
+	assert(err, "==", nil)
+	for i := 0; i < 8; i++ {
+		queue.PushOne(make([]byte, 200))
+	}
+	assert(len(queue.PopN(10)), "==", 4)
+	assert(len(queue.PopN(10)), "==", 4)
+	assert(queue.Segments(), "==", 2)
+	assert(queue.RemoveConsumer("shipper"), "==", nil)
+	assert(queue.Segments(), "==", 1)
+}
+
+func Test_segmented_packet_too_large(t *testing.T) {
+	assert := NewAssert(t)
+	queue := openNewSegmented(assert)
+	defer queue.Close()
+	err := queue.Push(make([]byte, 2048))
+	assert(errors.Is(err, ErrPacketTooLarge), "==", true)
+	assert(queue.Segments(), "==", 1)
+}
+
+func Test_segmented_removed_consumer_not_back_after_reopen(t *testing.T) {
+	assert := NewAssert(t)
+	queue := openNewSegmented(assert)
+	shipper, err := queue.Consumer("shipper")
+	assert(err, "==", nil)
+	for i := 0; i < 8; i++ {
+		queue.PushOne(make([]byte, 200))
+	}
+	assert(queue.Segments(), "==", 2)
+	// the default consumer keeps the first segment, the shipper moves on to the second
+	assert(len(shipper.PopN(10)), "==", 4)
+	assert(len(shipper.PopN(10)), "==", 4)
+	assert(shipper.Commit(), "==", nil)
+	assert(queue.RemoveConsumer("shipper"), "==", nil)
+	assert(queue.Segments(), "==", 2)
+	assert(queue.Close(), "==", nil)
+
+	queue, err = OpenSegmented("/tmp/drbuffer-segments", 1)
+	assert(err, "==", nil)
+	defer queue.Close()
+	shipper, err = queue.Consumer("shipper")
+	assert(err, "==", nil)
+	// registered again from the default consumer
+	assert(len(shipper.PopN(10)), "==", 4)
+}
@@ -0,0 +1,201 @@
+package drbuffer
+
+import (
+	"encoding/binary"
+	"fmt"
+	"hash/crc32"
+)
+
+// Flush copies the pointers into one of two shadow slots of the wide meta section once the data they point to is synced,
+// alternating so a torn write leaves the previous copy intact. each slot has a 512 bytes sector of its own,
+// apart from the pointers and the consumer table, a torn sector takes only one of them:
+// [8 generation][8 nextWriteFrom][8 lastReadTo][8 wrapAt][8 lastSequence][4 crc32c of the 40 bytes before]
+// there is no room for them before version 4, the pointers of those versions may be written back ahead of the data,
+// only the checksums of the records since version 2 catch it
+const SHADOW_META_OFFSET = 512
+const SHADOW_META_SLOT_SIZE = 512
+
+type shadowMeta struct {
+	generation    uint64
+	nextWriteFrom uint64
+	lastReadTo    uint64
+	wrapAt        uint64
+	lastSequence  uint64
+}
+
+func (buffer *ringBuffer) shadowSlot(slot uint64) []byte {
+	return buffer.meta[SHADOW_META_OFFSET+slot*SHADOW_META_SLOT_SIZE:][:44]
+}
+
+// readShadow fails for a slot never written or torn
+func (buffer *ringBuffer) readShadow(slot uint64) (shadowMeta, bool) {
+	raw := buffer.shadowSlot(slot)
+	if crc32.Checksum(raw[:40], castagnoliTable) != binary.LittleEndian.Uint32(raw[40:]) {
+		return shadowMeta{}, false
+	}
+	shadow := shadowMeta{
+		generation:    binary.LittleEndian.Uint64(raw[0:]),
+		nextWriteFrom: binary.LittleEndian.Uint64(raw[8:]),
+		lastReadTo:    binary.LittleEndian.Uint64(raw[16:]),
+		wrapAt:        binary.LittleEndian.Uint64(raw[24:]),
+		lastSequence:  binary.LittleEndian.Uint64(raw[32:]),
+	}
+	return shadow, shadow.generation != 0
+}
+
+// latestShadow is the intact copy of the highest generation
+func (buffer *ringBuffer) latestShadow() (shadowMeta, bool) {
+	if *buffer.version < FIRST_WIDE_VERSION {
+		return shadowMeta{}, false
+	}
+	latest, found := buffer.readShadow(0)
+	if shadow, ok := buffer.readShadow(1); ok && (!found || shadow.generation > latest.generation) {
+		return shadow, true
+	}
+	return latest, found
+}
+
+// writeShadow overwrites the slot of the older generation, there is no room for it before version 4
+func (buffer *ringBuffer) writeShadow() {
+	if *buffer.version < FIRST_WIDE_VERSION {
+		return
+	}
+	generation := uint64(1)
+	if latest, found := buffer.latestShadow(); found {
+		generation = latest.generation + 1
+	}
+	raw := buffer.shadowSlot(generation % 2)
+	binary.LittleEndian.PutUint64(raw[0:], generation)
+	binary.LittleEndian.PutUint64(raw[8:], buffer.nextWriteFrom.load())
+	binary.LittleEndian.PutUint64(raw[16:], buffer.lastReadTo.load())
+	binary.LittleEndian.PutUint64(raw[24:], buffer.wrapAt.load())
+	lastSequence := uint64(0)
+	if buffer.format.sequenced {
+		lastSequence = buffer.lastSequence.load()
+	}
+	binary.LittleEndian.PutUint64(raw[32:], lastSequence)
+	binary.LittleEndian.PutUint32(raw[40:], crc32.Checksum(raw[:40], castagnoliTable))
+}
+
+// dropOlderShadow zeroes the slot of the older generation, once its pointers do not fit the data section any more
+func (buffer *ringBuffer) dropOlderShadow() {
+	latest, found := buffer.latestShadow()
+	if !found {
+		return
+	}
+	raw := buffer.shadowSlot((latest.generation + 1) % 2)
+	copy(raw, make([]byte, len(raw)))
+}
+
+// restoreShadow falls back to the newest copy once the pointers in the meta page fail pointersConsistent, the meta page
+// was torn or written back before the data it points to. the records pushed after the copy are kept as far as the pointers
+// in the meta page claim, if they are intact and, since version 5, numbered after the copy: a record of an earlier lap is not
+// mistaken for one not synced yet. the pointers in the meta page are used for the pops after the copy too, where they fall
+// on a pending record
+func (buffer *ringBuffer) restoreShadow(report *RecoveryReport) {
+	shadow, found := buffer.latestShadow()
+	if !found || buffer.pointersConsistent() {
+		return
+	}
+	nextWriteFrom, wrapAt := buffer.durableEnd(shadow)
+	lastReadTo := shadow.lastReadTo
+	if buffer.walksPending(shadow.lastReadTo, buffer.lastReadTo.load(), nextWriteFrom, wrapAt) {
+		lastReadTo = buffer.lastReadTo.load()
+	}
+	if lastReadTo <= nextWriteFrom && buffer.wrapAt.load() == 0 {
+		// the readers left the previous lap after the copy
+		wrapAt = 0
+	}
+	if nextWriteFrom != buffer.nextWriteFrom.load() || lastReadTo != buffer.lastReadTo.load() || wrapAt != buffer.wrapAt.load() {
+		report.Repairs = append(report.Repairs, fmt.Sprintf("meta section restored from shadow generation %d", shadow.generation))
+	}
+	report.repair("nextWriteFrom", buffer.nextWriteFrom, nextWriteFrom)
+	report.repair("lastReadTo", buffer.lastReadTo, lastReadTo)
+	report.repair("wrapAt", buffer.wrapAt, wrapAt)
+	if buffer.format.sequenced && shadow.lastSequence > buffer.lastSequence.load() {
+		// the sequence numbers already handed out are never reused
+		report.repair("lastSequence", buffer.lastSequence, shadow.lastSequence)
+	}
+}
+
+// pointersConsistent tells if the pointers in the meta page lead through the pending records: in range, intact and,
+// since version 5, numbered upwards to lastSequence. the copy of an earlier Flush is older than them then
+func (buffer *ringBuffer) pointersConsistent() bool {
+	dataSize := uint64(len(buffer.data))
+	nextWriteFrom, lastReadTo, wrapAt := buffer.nextWriteFrom.load(), buffer.lastReadTo.load(), buffer.wrapAt.load()
+	if nextWriteFrom > dataSize || lastReadTo > dataSize || wrapAt > dataSize {
+		return false
+	}
+	readFrom, sequence := lastReadTo, uint64(0)
+	if lastReadTo > nextWriteFrom {
+		if wrapAt < lastReadTo {
+			return false
+		}
+		end := uint64(0)
+		if end, sequence = buffer.walkPushed(lastReadTo, wrapAt, sequence); end != wrapAt {
+			return false
+		}
+		readFrom = 0
+	}
+	end := uint64(0)
+	if end, sequence = buffer.walkPushed(readFrom, nextWriteFrom, sequence); end != nextWriteFrom {
+		return false
+	}
+	// the last pending record is the last pushed, unless the data did not reach the disk
+	return !buffer.format.sequenced || sequence == 0 || sequence == buffer.lastSequence.load()
+}
+
+// durableEnd follows the writer from the shadow copy through the records pushed after it, at most one wrap
+// and only if the new lap did not reach the packets pending in the copy
+func (buffer *ringBuffer) durableEnd(shadow shadowMeta) (nextWriteFrom uint64, wrapAt uint64) {
+	dataSize := uint64(len(buffer.data))
+	claimedWriteFrom, claimedWrapAt := buffer.nextWriteFrom.load(), buffer.wrapAt.load()
+	if claimedWriteFrom > dataSize || claimedWrapAt > dataSize {
+		// torn, nothing after the copy can be located
+		return shadow.nextWriteFrom, shadow.wrapAt
+	}
+	if claimedWriteFrom >= shadow.nextWriteFrom {
+		end, _ := buffer.walkPushed(shadow.nextWriteFrom, claimedWriteFrom, shadow.lastSequence)
+		return end, shadow.wrapAt
+	}
+	if claimedWrapAt < shadow.nextWriteFrom || shadow.lastReadTo > shadow.nextWriteFrom || claimedWriteFrom >= shadow.lastReadTo {
+		return shadow.nextWriteFrom, shadow.wrapAt
+	}
+	end, sequence := buffer.walkPushed(shadow.nextWriteFrom, claimedWrapAt, shadow.lastSequence)
+	if end != claimedWrapAt {
+		return end, shadow.wrapAt
+	}
+	end, _ = buffer.walkPushed(0, claimedWriteFrom, sequence)
+	return end, claimedWrapAt
+}
+
+// walkPushed returns the end of the records from readFrom which are intact and, since version 5, numbered after sequence
+func (buffer *ringBuffer) walkPushed(readFrom, readTo uint64, sequence uint64) (uint64, uint64) {
+	pos := readFrom
+	for pos < readTo {
+		_, recordSize, reason := buffer.format.read(buffer.data[pos:readTo])
+		if reason != "" {
+			break
+		}
+		if buffer.format.sequenced {
+			if buffer.format.sequence(buffer.data[pos:]) <= sequence {
+				// left over from an earlier lap
+				break
+			}
+			sequence = buffer.format.sequence(buffer.data[pos:])
+		}
+		pos += recordSize
+	}
+	return pos, sequence
+}
+
+// walksPending tells if readTo is on a record reached from readFrom without passing nextWriteFrom
+func (buffer *ringBuffer) walksPending(readFrom, readTo, nextWriteFrom, wrapAt uint64) bool {
+	if readFrom <= nextWriteFrom {
+		return readFrom <= readTo && readTo <= nextWriteFrom && buffer.walksTo(readFrom, readTo)
+	}
+	if readTo >= readFrom {
+		return readTo <= wrapAt && buffer.walksTo(readFrom, readTo)
+	}
+	return readTo <= nextWriteFrom && buffer.walksTo(readFrom, wrapAt) && buffer.walksTo(0, readTo)
+}
@@ -0,0 +1,270 @@
+package drbuffer
+
+import (
+	"fmt"
+	"testing"
+)
+
+func Test_flush_alternates_shadow_slots(t *testing.T) {
+	assert := NewAssert(t)
+	buffer := openNew(assert)
+	defer buffer.Close()
+	durableBuffer := buffer.(*durableRingBuffer)
+	_, found := durableBuffer.latestShadow()
+	assert(found, "==", false)
+	buffer.PushOne([]byte("A"))
+	assert(buffer.Flush(), "==", nil)
+	shadow, found := durableBuffer.latestShadow()
+	assert(found, "==", true)
+	assert(shadow, "==", shadowMeta{generation: 1, nextWriteFrom: 17, lastSequence: 1})
+	assert(string(buffer.PopOne()), "==", "A")
+	assert(buffer.Commit(), "==", nil)
+	assert(buffer.Flush(), "==", nil)
+	shadow, _ = durableBuffer.latestShadow()
+	assert(shadow, "==", shadowMeta{generation: 2, nextWriteFrom: 17, lastReadTo: 17, lastSequence: 1})
+	// the previous generation is kept in the other slot
+	previous, found := durableBuffer.readShadow(1)
+	assert(found, "==", true)
+	assert(previous.generation, "==", uint64(1))
+}
+
+func Test_recover_torn_meta_from_shadow(t *testing.T) {
+	assert := NewAssert(t)
+	buffer := newBufferOfVersion(5, 60)
+	buffer.PushN([][]byte{
+		[]byte("A"),
+		[]byte("B"),
+	})
+	buffer.writeShadow()
+	buffer.PushOne([]byte("C"))
+	// lastReadTo after nextWriteFrom without a previous lap
+	buffer.nextWriteFrom.store(3)
+	buffer.lastReadTo.store(9)
+	report := buffer.recover()
+	assert(report.Repairs, "==", []string{
+		"meta section restored from shadow generation 1",
+		"nextWriteFrom: 3 -> 34",
+		"lastReadTo: 9 -> 0",
+	})
+	assert(len(buffer.PopN(10)), "==", 2)
+	// the sequence numbers handed out after the shadow copy are not reused
+	sequence, _ := buffer.PushWithSequence([]byte("D"))
+	assert(sequence, "==", uint64(4))
+}
+
+func Test_recover_torn_shadow_uses_previous_generation(t *testing.T) {
+	assert := NewAssert(t)
+	buffer := newBufferOfVersion(5, 60)
+	buffer.PushOne([]byte("A"))
+	buffer.writeShadow()
+	buffer.PushOne([]byte("B"))
+	buffer.writeShadow()
+	buffer.shadowSlot(0)[8] ^= 0xff // generation 2 torn
+	buffer.nextWriteFrom.store(100)
+	report := buffer.recover()
+	assert(report.Repairs[0], "==", "meta section restored from shadow generation 1")
+	packets := buffer.PopN(10)
+	assert(len(packets), "==", 1)
+	assert(string(packets[0]), "==", "A")
+}
+
+func Test_recover_keeps_meta_not_torn(t *testing.T) {
+	assert := NewAssert(t)
+	buffer := newBufferOfVersion(5, 60)
+	buffer.PushOne([]byte("A"))
+	buffer.writeShadow()
+	buffer.PushOne([]byte("B"))
+	report := buffer.recover()
+	assert(report.Repaired(), "==", false)
+	assert(len(buffer.PopN(10)), "==", 2)
+}
+
+func Test_resize_writes_shadow(t *testing.T) {
+	assert := NewAssert(t)
+	buffer := openNew(assert)
+	buffer.PushN([][]byte{[]byte("A"), []byte("B")})
+	assert(string(buffer.PopOne()), "==", "A")
+	assert(buffer.Commit(), "==", nil)
+	assert(buffer.Flush(), "==", nil)
+	assert(buffer.Close(), "==", nil)
+	assert(Resize("/tmp/drbuffer", 2), "==", nil)
+	buffer, err := Open("/tmp/drbuffer", 2)
+	assert(err, "==", nil)
+	defer buffer.Close()
+	shadow, found := buffer.(*durableRingBuffer).latestShadow()
+	assert(found, "==", true)
+	assert(shadow, "==", shadowMeta{generation: 2, nextWriteFrom: 17, lastSequence: 2})
+	// the copy of the old geometry is not left for a torn newest slot to fall back to
+	_, found = buffer.(*durableRingBuffer).readShadow(1)
+	assert(found, "==", false)
+}
+
+func Test_recover_meta_written_back_before_data(t *testing.T) {
+	assert := NewAssert(t)
+	buffer := newBufferOfVersion(5, 60)
+	buffer.PushN([][]byte{
+		[]byte("A"),
+		[]byte("B"),
+		[]byte("C"),
+	})
+	assert(len(buffer.PopN(10)), "==", 3)
+	buffer.Commit()
+	buffer.PushN([][]byte{
+		[]byte("D"),
+		[]byte("E"),
+	})
+	buffer.writeShadow()
+	synced := append([]byte(nil), buffer.data...)
+	buffer.PushOne([]byte("F"))
+	// the meta page reached the disk, "F" did not, "C" of the previous lap is still there
+	copy(buffer.data, synced)
+	report := buffer.recover()
+	assert(report.Repairs, "==", []string{
+		"meta section restored from shadow generation 1",
+		"nextWriteFrom: 51 -> 34",
+	})
+	packets := buffer.PopN(10)
+	assert(len(packets), "==", 2)
+	assert(string(packets[0]), "==", "D")
+	assert(string(packets[1]), "==", "E")
+	// the sequence number of "F" is not reused
+	sequence, _ := buffer.PushWithSequence([]byte("G"))
+	assert(sequence, "==", uint64(7))
+}
+
+func Test_recover_keeps_pops_after_shadow(t *testing.T) {
+	assert := NewAssert(t)
+	buffer := newBufferOfVersion(5, 60)
+	buffer.PushN([][]byte{
+		[]byte("A"),
+		[]byte("B"),
+	})
+	buffer.writeShadow()
+	assert(string(buffer.PopOne()), "==", "A")
+	buffer.Commit()
+	report := buffer.recover()
+	assert(report.Repaired(), "==", false)
+	assert(string(buffer.PopOne()), "==", "B")
+}
+
+func Test_shadow_slots_in_sectors_of_their_own(t *testing.T) {
+	assert := NewAssert(t)
+	for slot := uint64(0); slot < 2; slot++ {
+		offset := SHADOW_META_OFFSET + slot*SHADOW_META_SLOT_SIZE
+		assert(offset%512, "==", uint64(0))
+		assert(offset >= 512, "==", true)
+		assert(offset+44 <= CONSUMER_TABLE_OFFSET, "==", true)
+	}
+}
+
+func Test_reopen_after_laps_not_flushed(t *testing.T) {
+	assert := NewAssert(t)
+	buffer := openNew(assert)
+	buffer.PushN([][]byte{[]byte("A"), []byte("B"), []byte("C")})
+	assert(buffer.Flush(), "==", nil)
+	for i := 0; i < 500; i++ {
+		buffer.PushOne([]byte(fmt.Sprintf("%08d", i)))
+		assert(len(buffer.PopN(10)) > 0, "==", true)
+		assert(buffer.Commit(), "==", nil)
+	}
+	assert(buffer.Stats().Wraps > 1, "==", true)
+	for i := 0; i < 5; i++ {
+		buffer.PushOne([]byte(fmt.Sprintf("pending%d", i)))
+	}
+	assert(buffer.Close(), "==", nil)
+	buffer, err := Open("/tmp/drbuffer", 1)
+	assert(err, "==", nil)
+	defer buffer.Close()
+	assert(buffer.RecoveryReport().Repaired(), "==", false)
+	packets := buffer.PopN(10)
+	assert(len(packets), "==", 5)
+	assert(string(packets[0]), "==", "pending0")
+}
+
+func Test_recover_keeps_meta_consistent_after_stale_shadow(t *testing.T) {
+	assert := NewAssert(t)
+	buffer := newBufferOfVersion(5, 60)
+	buffer.PushOne([]byte("A"))
+	buffer.writeShadow()
+	// killed without flushing again, the page cache kept everything
+	for i := 0; i < 20; i++ {
+		buffer.PushOne([]byte{byte('a' + i)})
+		assert(len(buffer.PopN(10)) > 0, "==", true)
+		buffer.Commit()
+	}
+	buffer.PushN([][]byte{[]byte("X"), []byte("Y")})
+	report := buffer.recover()
+	assert(report.Repaired(), "==", false)
+	packets := buffer.PopN(10)
+	assert(len(packets), "==", 2)
+	assert(string(packets[0]), "==", "X")
+}
+
+func Test_verify_closed_file_after_wrap(t *testing.T) {
+	assert := NewAssert(t)
+	buffer := openNew(assert)
+	buffer.PushOne([]byte("A"))
+	assert(buffer.Flush(), "==", nil)
+	for i := 0; i < 50; i++ {
+		buffer.PushOne([]byte(fmt.Sprintf("%08d", i)))
+		assert(len(buffer.PopN(10)) > 0, "==", true)
+		assert(buffer.Commit(), "==", nil)
+	}
+	assert(buffer.Stats().Wraps, "==", uint64(1))
+	buffer.PushOne([]byte("B"))
+	assert(buffer.Close(), "==", nil)
+	report, err := Verify("/tmp/drbuffer")
+	assert(err, "==", nil)
+	assert(report.Repairs, "==", []string(nil))
+	assert(report.PendingPackets, "==", 1)
+}
+
+// crashAfterCommitNotFlushed pushes over the space freed by a commit not flushed yet, then takes the flushed meta section
+// with the current data section like a crash would leave them
+func crashAfterCommitNotFlushed(assert Assert, lastPacketSize int) *ringBuffer {
+	buffer := openNew(assert)
+	defer buffer.Close()
+	for _, name := range []byte("ABCD") {
+		buffer.PushOne(append([]byte{name}, make([]byte, 199)...))
+	}
+	assert(buffer.Flush(), "==", nil)
+	durableBuffer := buffer.(*durableRingBuffer)
+	flushedMeta := append([]byte(nil), durableBuffer.meta...)
+	assert(len(buffer.PopN(2)), "==", 2)
+	assert(buffer.Commit(), "==", nil)
+	buffer.PushOne(append([]byte("E"), make([]byte, lastPacketSize-1)...))
+	assert(durableBuffer.wrapAt.load(), "==", uint64(864))
+	return NewRingBuffer(flushedMeta, append([]byte(nil), durableBuffer.data...))
+}
+
+func Test_recover_commit_not_flushed_partly_written_over(t *testing.T) {
+	assert := NewAssert(t)
+	buffer := crashAfterCommitNotFlushed(assert, 284)
+	report := buffer.recover()
+	assert(report.Repairs, "==", []string{
+		"lastSequence: 4 -> 5",
+		"lastReadTo: 0 -> 432",
+	})
+	assert(report.PendingPackets, "==", 2)
+	assert(report.TruncatedBytes, "==", uint64(0))
+	packets := buffer.PopN(10)
+	assert(len(packets), "==", 2)
+	assert(packets[0][0], "==", byte('C'))
+	assert(packets[1][0], "==", byte('D'))
+}
+
+func Test_recover_commit_not_flushed_written_over_in_order(t *testing.T) {
+	assert := NewAssert(t)
+	buffer := crashAfterCommitNotFlushed(assert, 200)
+	report := buffer.recover()
+	assert(report.Repairs, "==", []string{
+		"lastSequence: 4 -> 5",
+		"lastReadTo: 0 -> 216",
+	})
+	batch, err := buffer.Pop(10)
+	assert(err, "==", nil)
+	assert(batch.Sequences, "==", []uint64{2, 3, 4})
+	// the sequence number of "E" is not reused
+	sequence, _ := buffer.PushWithSequence([]byte("F"))
+	assert(sequence, "==", uint64(6))
+}
@@ -0,0 +1,200 @@
+package drbuffer
+
+import (
+	"errors"
+	"io"
+	"os"
+)
+
+// EvictionHandler receives a copy of a packet OverwriteOldest is about to drop, it is called with the buffer locked
+// so it must not use the buffer
+type EvictionHandler func(packet []byte, sequence uint64) error
+
+// ErrEvictionFailed is returned by the push which would drop the packets, the packet is not pushed and the others are kept.
+// the packets handed over before the failure are handed over again by the next push
+var ErrEvictionFailed = errors.New("failed to hand over evicted packets")
+
+// evictFunc hands over the packets of the records a push is about to overwrite, all of them at once
+type evictFunc func(packets [][]byte, sequences []uint64) error
+
+// recordSpan is a range of the data section, usually where a record is
+type recordSpan struct {
+	from uint64
+	to   uint64
+}
+
+// evictRecords passes the records a push is about to overwrite to evict
+func (buffer *ringBuffer) evictRecords(records []recordSpan) error {
+	packets := make([][]byte, len(records))
+	sequences := make([]uint64, len(records))
+	for i, span := range records {
+		record := buffer.data[span.from:span.to]
+		packet, _, _ := buffer.format.read(record)
+		packets[i] = append([]byte(nil), packet...)
+		sequences[i] = buffer.format.sequence(record)
+	}
+	return buffer.evict(packets, sequences)
+}
+
+func (buffer *durableRingBuffer) openSpill(opts options) error {
+	if opts.spillPath != "" {
+		spillFile, err := os.OpenFile(opts.spillPath, os.O_RDWR|os.O_CREATE|os.O_APPEND, 0644)
+		if err != nil {
+			return annotatedError{err, "failed to open spill file"}
+		}
+		buffer.spillFile = spillFile
+		if err = buffer.recoverSpill(); err != nil {
+			spillFile.Close()
+			return err
+		}
+	}
+	buffer.evict = func(packets [][]byte, sequences []uint64) error {
+		if buffer.spillFile != nil {
+			if err := buffer.spill(packets, sequences); err != nil {
+				return err
+			}
+		}
+		if opts.evictionHandler != nil {
+			for i, packet := range packets {
+				if err := opts.evictionHandler(packet, sequences[i]); err != nil {
+					return err
+				}
+			}
+		}
+		return nil
+	}
+	return nil
+}
+
+// recoverSpill cuts the torn record a crash while spilling left at the end
+func (buffer *durableRingBuffer) recoverSpill() error {
+	fi, err := buffer.spillFile.Stat()
+	if err != nil {
+		return annotatedError{err, "failed to get spill file size"}
+	}
+	if uint64(fi.Size()) < buffer.spillReadFrom.load() {
+		// the spill file has been replaced
+		buffer.spillReadFrom.store(0)
+	}
+	readFrom := buffer.spillReadFrom.load()
+	for {
+		packets, _, ends, err := buffer.readSpill(readFrom, ITERATOR_CHUNK_SIZE)
+		if err != nil {
+			return err
+		}
+		if len(packets) == 0 {
+			break
+		}
+		readFrom = ends[len(ends)-1]
+	}
+	if err := buffer.spillFile.Truncate(int64(readFrom)); err != nil {
+		return annotatedError{err, "failed to truncate spill file"}
+	}
+	return nil
+}
+
+// spill appends the records and syncs them before the ring is overwritten, a failed spill is cut off the file
+func (buffer *durableRingBuffer) spill(packets [][]byte, sequences []uint64) error {
+	records := []byte{}
+	for i, packet := range packets {
+		record := make([]byte, buffer.format.headerSize()+uint64(len(packet)))
+		buffer.format.write(record, packet, sequences[i])
+		records = append(records, record...)
+	}
+	fi, err := buffer.spillFile.Stat()
+	if err != nil {
+		return annotatedError{err, "failed to get spill file size"}
+	}
+	if _, err = buffer.spillFile.Write(records); err == nil {
+		if err = buffer.spillFile.Sync(); err == nil {
+			return nil
+		}
+		err = annotatedError{err, "failed to sync spill file"}
+	} else {
+		err = annotatedError{err, "failed to append to spill file"}
+	}
+	buffer.spillFile.Truncate(fi.Size())
+	return err
+}
+
+// readSpill reads at most maxPacketsCount records from readFrom, ends tells where each record ends in the file
+func (buffer *durableRingBuffer) readSpill(readFrom uint64, maxPacketsCount int) (packets [][]byte, sequences []uint64, ends []uint64, err error) {
+	header := make([]byte, buffer.format.headerSize())
+	for pos := readFrom; len(packets) < maxPacketsCount; {
+		if _, err = buffer.spillFile.ReadAt(header, int64(pos)); err == io.EOF {
+			break
+		} else if err != nil {
+			return nil, nil, nil, annotatedError{err, "failed to read spill file"}
+		}
+		packetSize := buffer.format.packetSize(header)
+		if packetSize > buffer.format.maxPacketSize() {
+			break
+		}
+		record := make([]byte, uint64(len(header))+packetSize)
+		if _, err = buffer.spillFile.ReadAt(record, int64(pos)); err == io.EOF {
+			break
+		} else if err != nil {
+			return nil, nil, nil, annotatedError{err, "failed to read spill file"}
+		}
+		packet, recordSize, reason := buffer.format.read(record)
+		if reason != "" {
+			break
+		}
+		pos += recordSize
+		packets = append(packets, packet)
+		sequences = append(sequences, buffer.format.sequence(record))
+		ends = append(ends, pos)
+	}
+	return packets, sequences, ends, nil
+}
+
+// DrainSpill hands the spilled packets to handle, oldest first, so the default consumer can catch up with them before popping the ring.
+// it stops at the first error of handle, the packet is handed again by next DrainSpill.
+// the spill file is emptied once drained, it does nothing without WithSpillFile
+func (buffer *durableRingBuffer) DrainSpill(handle func(packet []byte, sequence uint64) error) error {
+	for {
+		buffer.lock.Lock()
+		if buffer.closed {
+			buffer.lock.Unlock()
+			return ErrClosed
+		}
+		if buffer.spillFile == nil {
+			buffer.lock.Unlock()
+			return nil
+		}
+		packets, sequences, ends, err := buffer.readSpill(buffer.spillReadFrom.load(), ITERATOR_CHUNK_SIZE)
+		if err == nil && len(packets) == 0 {
+			// drained, nothing can be spilled while the lock is held
+			if err = buffer.spillFile.Truncate(0); err != nil {
+				err = annotatedError{err, "failed to truncate spill file"}
+			} else {
+				buffer.spillReadFrom.store(0)
+			}
+		}
+		buffer.lock.Unlock()
+		if err != nil || len(packets) == 0 {
+			return err
+		}
+		for i, packet := range packets {
+			if err := handle(packet, sequences[i]); err != nil {
+				if i > 0 {
+					buffer.commitSpill(ends[i-1])
+				}
+				return err
+			}
+		}
+		if err := buffer.commitSpill(ends[len(ends)-1]); err != nil {
+			return err
+		}
+	}
+}
+
+func (buffer *durableRingBuffer) commitSpill(readTo uint64) error {
+	buffer.lock.Lock()
+	defer buffer.lock.Unlock()
+	if buffer.closed {
+		return ErrClosed
+	}
+	buffer.spillReadFrom.store(readTo)
+	return nil
+}
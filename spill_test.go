@@ -0,0 +1,156 @@
+package drbuffer
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"testing"
+)
+
+func openNewWithSpill(assert Assert) DurableRingBuffer {
+	assert(ensureFileNotExist("/tmp/drbuffer"), "==", nil)
+	assert(ensureFileNotExist("/tmp/drbuffer.spill"), "==", nil)
+	buffer, err := Open("/tmp/drbuffer", 1, WithSpillFile("/tmp/drbuffer.spill"))
+	assert(err, "==", nil)
+	return buffer
+}
+
+func Test_spill_keeps_every_packet(t *testing.T) {
+	assert := NewAssert(t)
+	buffer := openNewWithSpill(assert)
+	defer buffer.Close()
+	popped := []uint64{}
+	for i := 0; i < 20; i++ {
+		buffer.PushOne([]byte(fmt.Sprintf("%d%s", i%10, make([]byte, 199))))
+		if i == 6 {
+			// popped packets are not spilled
+			batch, err := buffer.Pop(2)
+			assert(err, "==", nil)
+			assert(batch.Commit(), "==", nil)
+			popped = append(popped, batch.Sequences...)
+		}
+	}
+	assert(buffer.DroppedPackets(), "!=", uint64(0))
+	spilled := []uint64{}
+	assert(buffer.DrainSpill(func(packet []byte, sequence uint64) error {
+		assert(len(packet), "==", 200)
+		assert(packet[0], "==", byte('0'+(sequence-1)%10))
+		spilled = append(spilled, sequence)
+		return nil
+	}), "==", nil)
+	assert(uint64(len(spilled)), "==", buffer.DroppedPackets())
+	for i := 1; i < len(spilled); i++ {
+		assert(spilled[i] > spilled[i-1], "==", true)
+	}
+	batch, err := buffer.Pop(100)
+	assert(err, "==", nil)
+	seen := map[uint64]bool{}
+	for _, sequence := range append(append(popped, spilled...), batch.Sequences...) {
+		assert(seen[sequence], "==", false)
+		seen[sequence] = true
+	}
+	assert(len(seen), "==", 20)
+}
+
+func Test_drain_spill_stops_at_handler_error(t *testing.T) {
+	assert := NewAssert(t)
+	buffer := openNewWithSpill(assert)
+	for i := 0; i < 8; i++ {
+		buffer.PushOne(make([]byte, 200))
+	}
+	assert(buffer.DroppedPackets(), "==", uint64(4))
+	failed := errors.New("failed")
+	handled := []uint64{}
+	assert(buffer.DrainSpill(func(packet []byte, sequence uint64) error {
+		if sequence == 3 {
+			return failed
+		}
+		handled = append(handled, sequence)
+		return nil
+	}), "==", failed)
+	assert(handled, "==", []uint64{1, 2})
+	assert(buffer.Close(), "==", nil)
+
+	// the drained position survives reopen
+	buffer, err := Open("/tmp/drbuffer", 1, WithSpillFile("/tmp/drbuffer.spill"))
+	assert(err, "==", nil)
+	defer buffer.Close()
+	assert(buffer.DrainSpill(func(packet []byte, sequence uint64) error {
+		handled = append(handled, sequence)
+		return nil
+	}), "==", nil)
+	assert(handled, "==", []uint64{1, 2, 3, 4})
+	// emptied once drained
+	assert(buffer.DrainSpill(func(packet []byte, sequence uint64) error {
+		t.Fatal("nothing left to drain")
+		return nil
+	}), "==", nil)
+}
+
+func Test_eviction_handler(t *testing.T) {
+	assert := NewAssert(t)
+	assert(ensureFileNotExist("/tmp/drbuffer"), "==", nil)
+	evicted := []uint64{}
+	buffer, err := Open("/tmp/drbuffer", 1, WithEvictionHandler(func(packet []byte, sequence uint64) error {
+		evicted = append(evicted, sequence)
+		if sequence == 2 {
+			return errors.New("failed")
+		}
+		return nil
+	}))
+	assert(err, "==", nil)
+	defer buffer.Close()
+	for i := 0; i < 4; i++ {
+		buffer.PushOne(make([]byte, 200))
+	}
+	pushed, err := buffer.PushBatch([][]byte{make([]byte, 200), make([]byte, 200)})
+	assert(errors.Is(err, ErrEvictionFailed), "==", true)
+	// the first wrap would drop 1 and 2, the packet is not pushed and both are kept
+	assert(pushed, "==", 0)
+	assert(evicted, "==", []uint64{1, 2})
+	batch, err := buffer.Pop(10)
+	assert(err, "==", nil)
+	assert(batch.Sequences, "==", []uint64{1, 2, 3, 4})
+}
+
+func Test_spill_before_overwrite(t *testing.T) {
+	assert := NewAssert(t)
+	assert(ensureFileNotExist("/tmp/drbuffer"), "==", nil)
+	assert(ensureFileNotExist("/tmp/drbuffer.spill"), "==", nil)
+	spilled := 0
+	buffer, err := Open("/tmp/drbuffer", 1, WithSpillFile("/tmp/drbuffer.spill"), WithEvictionHandler(func(packet []byte, sequence uint64) error {
+		// the spilled record is synced to the file while the ring still holds the packet
+		spilled += 1
+		content, err := os.ReadFile("/tmp/drbuffer.spill")
+		assert(err, "==", nil)
+		assert(len(content) >= int(sequence)*(16+200), "==", true)
+		assert(content[(sequence-1)*(16+200)+16], "==", byte(sequence))
+		assert(packet[0], "==", byte(sequence))
+		return nil
+	}))
+	assert(err, "==", nil)
+	defer buffer.Close()
+	for i := 1; i <= 6; i++ {
+		packet := make([]byte, 200)
+		packet[0] = byte(i)
+		buffer.PushOne(packet)
+	}
+	assert(spilled, "==", int(buffer.DroppedPackets()))
+	assert(spilled, "!=", 0)
+}
+
+func Test_spill_rejected_before_version_4(t *testing.T) {
+	assert := NewAssert(t)
+	assert(ensureFileNotExist("/tmp/drbuffer"), "==", nil)
+	content := make([]byte, 16+1024)
+	content[0] = 3
+	assert(os.WriteFile("/tmp/drbuffer", content, 0644), "==", nil)
+	_, err := Open("/tmp/drbuffer", 1, WithSpillFile("/tmp/drbuffer.spill"))
+	assert(err.Error(), "==", "spill file not supported before version 4, the drained position can not be persisted")
+}
+
+func Test_spill_rejected_across_processes(t *testing.T) {
+	assert := NewAssert(t)
+	_, err := Open("/tmp/drbuffer", 1, WithRole(ConsumeOnly), WithSpillFile("/tmp/drbuffer.spill"))
+	assert(err, "!=", nil)
+}
@@ -0,0 +1,58 @@
+package drbuffer
+
+import "time"
+
+// Stats is a snapshot of the buffer as seen by the default consumer
+type Stats struct {
+	PendingPackets int    // packets PopN would return
+	PendingBytes   uint64 // bytes of the records PopN would return, headers included
+	FreeBytes      uint64 // bytes not holding packets uncommitted by any consumer
+	Capacity       uint64 // bytes of the data section
+	TotalPushed    uint64
+	TotalPopped    uint64        // redelivered packets are counted again
+	DroppedPackets uint64        // overwritten before popped
+	Wraps          uint64        // times the writer wrapped around to the start of the data section
+	Flushes        uint64        // calls of Flush since Open, and flushes of the sync policy
+	FlushDuration  time.Duration // spent in Flush since Open
+}
+
+// stats counts from version 4 survive reopen, before that they start from 0 on Open
+func (buffer *ringBuffer) stats() Stats {
+	capacity := uint64(len(buffer.data))
+	return Stats{
+		PendingPackets: buffer.cursor.pendingPackets(),
+		PendingBytes:   buffer.bytesFrom(buffer.cursor.nextReadFrom),
+		FreeBytes:      capacity - buffer.bytesFrom(buffer.oldestReadTo()),
+		Capacity:       capacity,
+		TotalPushed:    buffer.totalPushed.load(),
+		TotalPopped:    buffer.cursor.poppedPackets.load(),
+		DroppedPackets: buffer.cursor.droppedPackets.load(),
+		Wraps:          buffer.wraps.load(),
+	}
+}
+
+// bytesFrom counts the bytes from the read position to nextWriteFrom
+func (buffer *ringBuffer) bytesFrom(readFrom uint64) uint64 {
+	nextWriteFrom := buffer.nextWriteFrom.load()
+	if readFrom > nextWriteFrom {
+		wrapAt := buffer.wrapAt.load()
+		if readFrom > wrapAt {
+			return nextWriteFrom
+		}
+		return wrapAt - readFrom + nextWriteFrom
+	}
+	return nextWriteFrom - readFrom
+}
+
+// Stats is empty after Close
+func (buffer *durableRingBuffer) Stats() Stats {
+	buffer.lock.Lock()
+	defer buffer.lock.Unlock()
+	if buffer.closed {
+		return Stats{}
+	}
+	stats := buffer.ringBuffer.stats()
+	stats.Flushes = buffer.flushes
+	stats.FlushDuration = buffer.flushDuration
+	return stats
+}
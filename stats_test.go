@@ -0,0 +1,110 @@
+package drbuffer
+
+import (
+	"testing"
+)
+
+func Test_stats(t *testing.T) {
+	assert := NewAssert(t)
+	buffer := newBufferOfVersion(5, 60)
+	recordSize := buffer.format.headerSize() + 1
+	buffer.PushN([][]byte{
+		[]byte("A"),
+		[]byte("B"),
+		[]byte("C"),
+	})
+	assert(len(buffer.PopN(1)), "==", 1)
+	assert(buffer.stats(), "==", Stats{
+		PendingPackets: 2,
+		PendingBytes:   2 * recordSize,
+		FreeBytes:      60 - 3*recordSize, // "A" is not committed yet
+		Capacity:       60,
+		TotalPushed:    3,
+		TotalPopped:    1,
+	})
+	// wraps around and overwrites "A", the reader is moved past "B" as it can not be where the writer is
+	buffer.PushOne([]byte("D"))
+	assert(buffer.PopN(10), "==", [][]byte{[]byte("C"), []byte("D")})
+	buffer.Commit()
+	buffer.PushOne([]byte("E"))
+	stats := buffer.stats()
+	assert(stats.Wraps, "==", uint64(1))
+	assert(stats.DroppedPackets, "==", uint64(1))
+	assert(stats.TotalPopped, "==", uint64(3))
+	assert(stats.PendingPackets, "==", 1)
+	assert(stats.PendingBytes, "==", recordSize)
+	assert(stats.FreeBytes, "==", 60-recordSize)
+}
+
+func Test_stats_count_dropped_and_wraps(t *testing.T) {
+	assert := NewAssert(t)
+	buffer := newBufferOfVersion(5, 60)
+	for i := 0; i < 8; i++ {
+		buffer.PushOne([]byte("A"))
+	}
+	stats := buffer.stats()
+	assert(stats.TotalPushed, "==", uint64(8))
+	assert(stats.Wraps, "==", uint64(2))
+	assert(stats.DroppedPackets, "==", uint64(8-stats.PendingPackets))
+}
+
+func Test_stats_survive_reopen(t *testing.T) {
+	assert := NewAssert(t)
+	buffer := openNew(assert)
+	shipper, err := buffer.Consumer("shipper")
+	assert(err, "==", nil)
+	for i := 0; i < 10; i++ {
+		buffer.PushOne(make([]byte, 200))
+	}
+	assert(len(buffer.PopN(2)), "==", 2)
+	assert(len(shipper.PopN(3)), "==", 3)
+	assert(shipper.Commit(), "==", nil)
+	before := buffer.Stats()
+	shipperDropped := shipper.DroppedPackets()
+	assert(shipperDropped, "!=", uint64(0))
+	assert(buffer.Close(), "==", nil)
+	meta, err := ReadMeta("/tmp/drbuffer")
+	assert(err, "==", nil)
+	assert(meta.Consumers[0].PoppedPackets, "==", uint64(3))
+	assert(buffer.Stats(), "==", Stats{})
+	buffer, err = Open("/tmp/drbuffer", 1)
+	assert(err, "==", nil)
+	defer buffer.Close()
+	assert(buffer.Stats().TotalPushed, "==", before.TotalPushed)
+	assert(buffer.Stats().TotalPopped, "==", before.TotalPopped)
+	assert(buffer.Stats().DroppedPackets, "==", before.DroppedPackets)
+	assert(buffer.Stats().Wraps, "==", before.Wraps)
+	shipper, err = buffer.Consumer("shipper")
+	assert(err, "==", nil)
+	assert(shipper.DroppedPackets(), "==", shipperDropped)
+}
+
+func Test_stats_keep_pending_packets_without_walking(t *testing.T) {
+	assert := NewAssert(t)
+	buffer := newBufferOfVersion(5, 60)
+	shipper, err := buffer.consumer("shipper")
+	assert(err, "==", nil)
+	walked := func(cursor *cursor) int {
+		assert(cursor.pendingCounted, "==", true)
+		return cursor.countPending()
+	}
+	assert(buffer.stats().PendingPackets, "==", 0)
+	assert(shipper.pendingPackets(), "==", 0)
+	for i := 0; i < 8; i++ {
+		buffer.PushOne([]byte("A"))
+		if i%3 == 0 {
+			buffer.PopN(1)
+		}
+		assert(buffer.cursor.pendingCount, "==", walked(&buffer.cursor))
+		assert(shipper.pendingCount, "==", walked(shipper))
+	}
+	assert(buffer.stats().DroppedPackets, "!=", uint64(0))
+	shipper.PopN(2)
+	assert(shipper.pendingCount, "==", walked(shipper))
+	// redelivered packets are pending again
+	batch, err := buffer.Pop(10)
+	assert(err, "==", nil)
+	assert(buffer.stats().PendingPackets, "==", 0)
+	assert(batch.Nack(), "==", nil)
+	assert(buffer.stats().PendingPackets, "==", len(batch.Packets))
+}
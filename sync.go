@@ -0,0 +1,101 @@
+package drbuffer
+
+import (
+	"errors"
+	"fmt"
+	"time"
+)
+
+// SyncPolicy tells when the pushed packets are flushed to disk without calling Flush
+type SyncPolicy struct {
+	mode     syncMode
+	interval time.Duration
+	bytes    uint64
+}
+
+type syncMode int
+
+const (
+	syncManual syncMode = iota
+	syncEveryPush
+	syncEveryBatch
+	syncEveryInterval
+	syncEveryBytes
+)
+
+// SyncManual leaves it to Flush, it is the default
+var SyncManual = SyncPolicy{mode: syncManual}
+
+// SyncEveryPush flushes after every packet, including every packet of PushN and PushBatch
+var SyncEveryPush = SyncPolicy{mode: syncEveryPush}
+
+// SyncEveryBatch flushes once every call of Push, PushOne, PushN and PushBatch
+var SyncEveryBatch = SyncPolicy{mode: syncEveryBatch}
+
+// SyncEveryInterval flushes from a background goroutine if anything was pushed in the interval,
+// Close stops the goroutine. its errors are returned by the next Flush or Close
+func SyncEveryInterval(interval time.Duration) SyncPolicy {
+	return SyncPolicy{mode: syncEveryInterval, interval: interval}
+}
+
+// SyncEveryBytes flushes from the push once the records pushed since last flush reach the size
+func SyncEveryBytes(bytes uint64) SyncPolicy {
+	return SyncPolicy{mode: syncEveryBytes, bytes: bytes}
+}
+
+// ErrSyncFailed is returned by the push the sync policy failed to flush, the pushed packets are kept
+var ErrSyncFailed = errors.New("failed to sync pushed packets")
+
+// pushedAnyway tells if the push failed after the packet went into the ring
+func pushedAnyway(err error) bool {
+	return errors.Is(err, ErrSyncFailed)
+}
+
+// syncAfterPacket expects the lock held
+func (buffer *durableRingBuffer) syncAfterPacket(recordSize uint64) error {
+	buffer.unsyncedBytes += recordSize
+	if buffer.syncPolicy.mode == syncEveryPush ||
+		(buffer.syncPolicy.mode == syncEveryBytes && buffer.unsyncedBytes >= buffer.syncPolicy.bytes) {
+		return buffer.syncPushed()
+	}
+	return nil
+}
+
+// syncAfterBatch expects the lock held
+func (buffer *durableRingBuffer) syncAfterBatch() error {
+	if buffer.syncPolicy.mode == syncEveryBatch && buffer.unsyncedBytes > 0 {
+		return buffer.syncPushed()
+	}
+	return nil
+}
+
+func (buffer *durableRingBuffer) syncPushed() error {
+	if err := buffer.flush(); err != nil {
+		return fmt.Errorf("%w: %s", ErrSyncFailed, err.Error())
+	}
+	return nil
+}
+
+// startSyncer flushes every interval until the buffer is closed
+func (buffer *durableRingBuffer) startSyncer() {
+	buffer.syncerStopped = make(chan struct{})
+	go func() {
+		defer close(buffer.syncerStopped)
+		ticker := time.NewTicker(buffer.syncPolicy.interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-buffer.done:
+				return
+			case <-ticker.C:
+			}
+			buffer.lock.Lock()
+			if !buffer.closed && buffer.unsyncedBytes > 0 {
+				if err := buffer.flush(); err != nil && buffer.syncErr == nil {
+					buffer.syncErr = err
+				}
+			}
+			buffer.lock.Unlock()
+		}
+	}()
+}
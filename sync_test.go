@@ -0,0 +1,96 @@
+package drbuffer
+
+import (
+	"testing"
+	"time"
+)
+
+func openNewWithSyncPolicy(assert Assert, policy SyncPolicy) DurableRingBuffer {
+	assert(ensureFileNotExist("/tmp/drbuffer"), "==", nil)
+	buffer, err := Open("/tmp/drbuffer", 1, WithSyncPolicy(policy))
+	assert(err, "==", nil)
+	return buffer
+}
+
+func Test_sync_manual(t *testing.T) {
+	assert := NewAssert(t)
+	buffer := openNewWithSyncPolicy(assert, SyncManual)
+	defer buffer.Close()
+	buffer.PushN([][]byte{[]byte("A"), []byte("B")})
+	buffer.PushOne([]byte("C"))
+	assert(buffer.Stats().Flushes, "==", uint64(0))
+}
+
+func Test_sync_every_push(t *testing.T) {
+	assert := NewAssert(t)
+	buffer := openNewWithSyncPolicy(assert, SyncEveryPush)
+	defer buffer.Close()
+	buffer.PushN([][]byte{[]byte("A"), []byte("B")})
+	buffer.PushOne([]byte("C"))
+	assert(buffer.Stats().Flushes, "==", uint64(3))
+}
+
+func Test_sync_every_batch(t *testing.T) {
+	assert := NewAssert(t)
+	buffer := openNewWithSyncPolicy(assert, SyncEveryBatch)
+	defer buffer.Close()
+	buffer.PushN([][]byte{[]byte("A"), []byte("B")})
+	buffer.PushOne([]byte("C"))
+	assert(buffer.Stats().Flushes, "==", uint64(2))
+	// nothing to sync
+	pushed, err := buffer.PushBatch(nil)
+	assert(pushed, "==", 0)
+	assert(err, "==", nil)
+	assert(buffer.Stats().Flushes, "==", uint64(2))
+}
+
+func Test_sync_every_bytes(t *testing.T) {
+	assert := NewAssert(t)
+	buffer := openNewWithSyncPolicy(assert, SyncEveryBytes(500))
+	defer buffer.Close()
+	for i := 0; i < 6; i++ {
+		buffer.PushOne(make([]byte, 200))
+	}
+	// every third record of 216 bytes crosses 500 bytes
+	assert(buffer.Stats().Flushes, "==", uint64(2))
+}
+
+func Test_sync_every_interval(t *testing.T) {
+	assert := NewAssert(t)
+	buffer := openNewWithSyncPolicy(assert, SyncEveryInterval(10*time.Millisecond))
+	buffer.PushOne([]byte("A"))
+	deadline := time.Now().Add(time.Second)
+	for buffer.Stats().Flushes == 0 && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond)
+	}
+	assert(buffer.Stats().Flushes, "==", uint64(1))
+	// nothing pushed since
+	time.Sleep(50 * time.Millisecond)
+	assert(buffer.Stats().Flushes, "==", uint64(1))
+	assert(buffer.Close(), "==", nil)
+	select {
+	case <-buffer.(*durableRingBuffer).syncerStopped:
+	default:
+		t.Fatal("syncer should be stopped by Close")
+	}
+	_, err := Open("/tmp/drbuffer", 1, WithSyncPolicy(SyncEveryInterval(0)))
+	assert(err, "!=", nil)
+}
+
+func Test_close_syncs_what_the_policy_has_not(t *testing.T) {
+	assert := NewAssert(t)
+	buffer := openNewWithSyncPolicy(assert, SyncEveryInterval(time.Hour))
+	buffer.PushOne([]byte("A"))
+	durableBuffer := buffer.(*durableRingBuffer)
+	assert(buffer.Close(), "==", nil)
+	assert(durableBuffer.flushes, "==", uint64(1))
+}
+
+func Test_close_does_not_sync_manual(t *testing.T) {
+	assert := NewAssert(t)
+	buffer := openNewWithSyncPolicy(assert, SyncManual)
+	buffer.PushOne([]byte("A"))
+	durableBuffer := buffer.(*durableRingBuffer)
+	assert(buffer.Close(), "==", nil)
+	assert(durableBuffer.flushes, "==", uint64(0))
+}